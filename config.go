@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configAliases maps readable config keys to short flag names,
+// all other keys are flag names as is
+var configAliases = map[string]string{
+	"listen":  "l",
+	"pac":     "p",
+	"refresh": "r",
+}
+
+// repeatableFlags accumulate values instead of replacing them
+var repeatableFlags = map[string]bool{
+	"upstream-auth":   true,
+	"upstream-ntlm":   true,
+	"override":        true,
+	"connect-scheme":  true,
+	"response-header": true,
+}
+
+// loadConfig sets flags from the yaml file path,
+// flags given on the command line take precedence
+func loadConfig(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(buf, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for key, value := range values {
+		name := key
+		if alias, ok := configAliases[key]; ok {
+			name = alias
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown option %s", path, key)
+		}
+		if explicit[name] {
+			continue
+		}
+
+		// lists set repeatable flags once per item, others are joined by comma
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		if !repeatableFlags[name] {
+			var strs []string
+			for _, item := range items {
+				strs = append(strs, fmt.Sprint(item))
+			}
+			items = []interface{}{strings.Join(strs, ",")}
+		}
+
+		for _, item := range items {
+			if err := flag.Set(name, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, key, err)
+			}
+		}
+	}
+	return nil
+}
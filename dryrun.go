@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/darren/pacroxy/proxy"
+)
+
+// runTest prints the proxies found for each url line of path to w,
+// blank lines and lines starting with # are skipped.
+// It fails when any url could not be resolved so CI can catch pac regressions.
+func runTest(server *proxy.Server, path string, w io.Writer) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var failed int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		proxies, err := server.FindProxy(line)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\tERROR: %v\n", line, err)
+			continue
+		}
+
+		directives := make([]string, 0, len(proxies))
+		for _, p := range proxies {
+			directives = append(directives, p.String())
+		}
+		fmt.Fprintf(w, "%s\t%s\n", line, strings.Join(directives, "; "))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d urls failed", failed)
+	}
+	return nil
+}
@@ -1,5 +1,12 @@
 module github.com/darren/pacroxy
 
-require github.com/darren/gpac v0.0.0-20200702020854-d9398608e64a
+require (
+	github.com/darren/gpac v0.0.0-20200702020854-d9398608e64a
+	github.com/prometheus/client_golang v1.7.1
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	gopkg.in/yaml.v2 v2.3.0
+)
 
 go 1.14
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darren/pacroxy/proxy"
+)
+
+// environment passing listeners to the process taking over
+const (
+	listenersEnv = "PACROXY_LISTENERS" // comma separated addresses of the listeners from fd 3 on
+	readyEnv     = "PACROXY_READY_FD"  // fd the process taking over writes to once it serves
+)
+
+// handoffTimeout is how long the new process may take to get ready
+const handoffTimeout = 30 * time.Second
+
+// inheritListeners returns the listeners handed over by the previous process
+func inheritListeners() (map[string]net.Listener, error) {
+	v := os.Getenv(listenersEnv)
+	if v == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenersEnv)
+
+	listeners := make(map[string]net.Listener)
+	for i, addr := range strings.Split(v, ",") {
+		f := os.NewFile(uintptr(3+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherit listener %s: %v", addr, err)
+		}
+		listeners[addr] = l
+	}
+	return listeners, nil
+}
+
+// notifyReady tells the previous process to drain, it is a no-op
+// unless the listeners were handed over
+func notifyReady() {
+	v := os.Getenv(readyEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(readyEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handoff starts pacroxy again with the same arguments, passing it the
+// listeners of server, and waits until it is ready to serve them
+func handoff(server *proxy.Server) error {
+	if *pacfile == "-" {
+		return errors.New("pac read from stdin can not be handed over")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	files, err := server.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	addrs := make([]string, 0, len(files))
+	for addr := range files {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	extra := make([]*os.File, 0, len(addrs)+1)
+	for _, addr := range addrs {
+		extra = append(extra, files[addr])
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(extra, w)
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(addrs, ","),
+		readyEnv+"="+strconv.Itoa(3+len(extra)),
+	)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+			return fmt.Errorf("new process %d exited before it was ready", cmd.Process.Pid)
+		}
+	case <-time.After(handoffTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process %d not ready after %v", cmd.Process.Pid, handoffTimeout)
+	}
+
+	log.Printf("Handed listeners over to process %d", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
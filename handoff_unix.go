@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// handoffSignal makes pacroxy hand its listeners over to a new process
+var handoffSignal os.Signal = syscall.SIGUSR2
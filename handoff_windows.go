@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// handoffSignal is nil, listeners can not be handed over on windows
+var handoffSignal os.Signal
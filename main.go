@@ -4,287 +4,274 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/darren/gpac"
+	"github.com/darren/pacroxy/proxy"
 )
 
-var pacfile = flag.String("p", "wpad.dat", "pac file to load")
-var addr = flag.String("l", "127.0.0.1:8080", "Listening address")
-var refresh = flag.Duration("r", 0, "Time duration to refresh pac file")
-
-// Server the proxy server
-type Server struct {
-	http.Server
-	sync.Mutex
-
-	pacfile         string
-	pac             *gpac.Parser
-	refreshDuration time.Duration
-}
-
-func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodConnect {
-		s.handleConnect(w, r)
-	} else {
-		s.handleHTTP(w, r)
-	}
-}
-
-type peekedConn struct {
-	net.Conn
-	r io.Reader
-}
-
-// combine combines conn and peeked buffer
-func combine(peeked io.Reader, conn net.Conn) *peekedConn {
-	r := io.MultiReader(peeked, conn)
-	return &peekedConn{conn, r}
-}
-
-func (p *peekedConn) Read(data []byte) (int, error) {
-	return p.r.Read(data)
-}
-
-// Copied from https://github.com/golang/go/blob/master/src/net/http/httputil/reverseproxy.go
-
-// Hop-by-hop headers. These are removed when sent to the backend.
-// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
-var hopHeaders = []string{
-	"Connection",
-	"Keep-Alive",
-	"Proxy-Authenticate",
-	"Proxy-Authorization",
-	"Te", // canonicalized version of "TE"
-	"Trailers",
-	"Transfer-Encoding",
-	"Upgrade",
-}
+// set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
 
-// removeConnectionHeaders removes hop-by-hop headers listed in the "Connection" header of h.
-// See RFC 7230, section 6.1
-func removeConnectionHeaders(h http.Header) {
-	if c := h.Get("Connection"); c != "" {
-		for _, f := range strings.Split(c, ",") {
-			if f = strings.TrimSpace(f); f != "" {
-				h.Del(f)
-			}
-		}
-	}
+var showVersion = flag.Bool("version", false, "Print version and build info and exit")
+var config = flag.String("config", "", "Yaml file of options keyed by flag name, flags on the command line take precedence")
+var pacfile = flag.String("p", "wpad.dat", "pac file to load, - reads stdin, multiple pac files can be separated by comma, ${VAR} is expanded from the environment")
+var wpad = flag.Bool("wpad", false, "Discover pac url with WPAD from dns search domains, falls back to -p when discovery fails")
+var pacURL = flag.String("pac-url", "full", "Url of http requests passed to pac: full passes it whole, host only scheme://host/ as for CONNECT")
+var pacMerge = flag.String("pac-merge", "first", "How results of multiple pac files are merged: first uses the first non-DIRECT result, concat joins all results")
+var addr = flag.String("l", "127.0.0.1:8080", "Listening addresses separated by comma, unix:/path listens on a unix socket, ${VAR} is expanded from the environment")
+var refresh = flag.Duration("r", 0, "Time duration to refresh pac file")
+var timeout = flag.Duration("timeout", 30*time.Second, "Timeout for fetching remote pac file")
+var userAgent = flag.String("user-agent", "pacroxy/"+version, "User-Agent sent when fetching remote pac files and discovering WPAD")
+var pacTimeout = flag.Duration("pac-timeout", 5*time.Second, "Timeout for evaluating FindProxyForURL, a pac timing out fails until reloaded, 0 means no timeout")
+var dialTimeout = flag.Duration("dial-timeout", 10*time.Second, "Timeout for dialing each proxy, 0 means no timeout")
+var retries = flag.Int("retries", 0, "Times to retry a failed dial or request on the same proxy before trying the next")
+var retryBackoff = flag.Duration("retry-backoff", 100*time.Millisecond, "Initial backoff between retries, doubled on each retry")
+var tunnelIdle = flag.Duration("tunnel-idle-timeout", 0, "Close CONNECT tunnels idle in both directions for this long, 0 disables")
+var readTimeout = flag.Duration("read-timeout", 0, "Timeout for reading a whole http response from upstream, 0 means no timeout")
+var headerTimeout = flag.Duration("response-header-timeout", 30*time.Second, "Timeout for awaiting http response headers from each upstream, 0 means no timeout")
+var slowThreshold = flag.Duration("slow-threshold", 0, "Warn about requests and tunnel setups taking longer than this, 0 disables")
+var readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "Timeout for reading request headers from clients, 0 means no timeout")
+var idleConnTimeout = flag.Duration("idle-conn-timeout", 90*time.Second, "Time idle upstream connections are kept for reuse, 0 keeps them until closed by the peer")
+var maxIdleConns = flag.Int("max-idle-conns", 100, "Idle connections kept for reuse per upstream proxy and in total for DIRECT, 0 uses the net/http defaults")
+var keepAlive = flag.Duration("keepalive", 3*time.Minute, "TCP keep-alive period of client connections, negative disables")
+var reusePort = flag.Bool("reuse-port", false, "Set SO_REUSEPORT on the proxy listeners so a restarted proxy binds while the old one drains, linux only")
+var fastOpen = flag.Int("tcp-fastopen", 0, "TCP Fast Open queue length of the proxy listeners, 0 disables, linux only")
+var maxHeaderBytes = flag.Int("max-header-bytes", 0, "Maximum size of client request headers, 0 uses the default of 1MB")
+var maxClients = flag.Int("max-clients", 0, "Maximum requests and tunnels handled at once, more are refused with 503, 0 means unlimited")
+var maxBodyBytes = flag.Int64("max-body-bytes", 0, "Maximum size of client request bodies, larger ones are refused with 413, 0 means unlimited")
+var metricsAddr = flag.String("metrics-addr", "", "Listening address for prometheus metrics and the /stats, /debug/pac, /reload, /drain and /version admin endpoints, empty to disable")
+var metricsRequired = flag.Bool("metrics-required", false, "Exit when -metrics-addr can not be bound instead of running without it")
+var logFormat = flag.String("log-format", "text", "Access log format: text or json")
+var auth = flag.String("auth", "", "Require clients to authenticate with user:pass")
+var authFile = flag.String("auth-file", "", "File of user:pass lines clients may authenticate with")
+var allow = flag.String("allow", "", "Comma separated CIDRs clients may connect from, empty allows all, unix socket clients are left to the socket permissions")
+var requestIDHeader = flag.String("request-id-header", "", "Header of the request id logged for each request, taken from clients sending one and forwarded, eg: X-Request-ID, empty only logs it")
+var forceAllow = flag.String("allow-force-header", "", "Comma separated CIDRs of clients which may pick proxies with an X-Pacroxy-Force: PROXY host:port header, empty disables")
+var forceClients = flag.String("allow-force-client", "", "Comma separated client certificate names (CN or SAN) which may use X-Pacroxy-Force, requires -client-ca")
+var upstreamInsecure = flag.Bool("upstream-insecure", false, "Skip verifying certificates of HTTPS proxies returned by pac")
+var upstreamCreds = make(proxy.UpstreamAuth)
+var upstreamNTLM = make(proxy.UpstreamNTLM)
+var overrides proxy.Overrides
+var responseHeaders proxy.HeaderRules
+var connectSchemes = make(proxy.PortSchemes)
+var connectPorts = flag.String("connect-ports", "all", "Comma separated ports and lo-hi ranges CONNECT and socks5 may tunnel to, others get 403, eg: 443,8443, all allows any port")
+var noProxy = flag.String("no-proxy", "", "Comma separated hosts, domains, IPs and CIDRs always connected directly bypassing pac like NO_PROXY, eg: localhost,.corp.com,10.0.0.0/8")
+var nextHop = flag.String("next-hop", "", "Http proxy host:port all connections are finally made through, pac only selects the routes before it")
+var healthPath = flag.String("health-path", "/healthz", "Path of the health check endpoint, empty to disable")
+var pacPath = flag.String("pac-path", "", "Path the first loaded pac file is served at to clients, eg: /wpad.dat, empty to disable")
+var cacheSize = flag.Int("cache-size", 0, "Number of hosts to cache pac results for, 0 disables the cache")
+var cacheTTL = flag.Duration("cache-ttl", time.Minute, "Time to keep cached pac results, 0 keeps them until evicted or pac reloaded")
+var dnsCacheTTL = flag.Duration("dns-cache-ttl", 0, "Time to cache host lookups of direct connections, 0 disables the cache")
+var ipVersion = flag.String("ip-version", "auto", "IP version of direct connections: auto, 4 or 6")
+var directFallback = flag.Bool("direct-fallback", false, "Connect directly when all proxies returned by pac failed")
+var breakerThreshold = flag.Int("breaker-threshold", 0, "Skip a proxy for -breaker-cooldown after this many consecutive failures, 0 disables")
+var breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "Time to skip a failing proxy before probing it again")
+var smartSelect = flag.Bool("smart-select", false, "Try the proxies returned by pac fastest first, by their recent latency and success rate")
+var rateLimit = flag.Int("rate-limit", 0, "Bytes per second each connection may transfer, 0 means unlimited")
+var rateLimitShared = flag.Bool("rate-limit-shared", false, "Apply -rate-limit to all connections together instead of each connection")
+var tlsCert = flag.String("tls-cert", "", "Certificate file to serve the proxy over tls, requires -tls-key")
+var tlsKey = flag.String("tls-key", "", "Private key file for -tls-cert")
+var noHTTP2 = flag.Bool("no-http2", false, "Serve -tls-cert clients http/1.1 only instead of negotiating http/2")
+var clientCA = flag.String("client-ca", "", "Pem file of CAs to require and verify client certificates against, requires -tls-cert")
+var maxConnsPerProxy = flag.Int("max-conns-per-proxy", 0, "Maximum concurrent connections to each upstream proxy, 0 means unlimited")
+var proxyLimitWait = flag.Duration("proxy-limit-wait", 0, "Time to wait for a proxy at -max-conns-per-proxy before trying the next, 0 skips it at once")
+var verboseErrors = flag.Bool("verbose-errors", false, "Include the last upstream error and proxies tried in error responses to clients")
+var via = flag.String("via", "", "Identity appended to the Via header of forwarded requests, empty to disable")
+var stripHeaders = flag.String("strip-headers", "", "Comma separated request headers removed before forwarding")
+var hopHeaders = flag.String("hop-headers", "", "Comma separated headers removed from requests and responses as hop-by-hop in addition to the standard ones")
+var noXFF = flag.Bool("no-xff", false, "Do not add X-Forwarded-For and X-Forwarded-Proto to forwarded requests")
+var blockMethods = flag.String("block-methods", "", "Comma separated request methods rejected with 405, eg: TRACE,TRACK")
+var socksAddr = flag.String("socks-addr", "", "Listening address for socks5 proxy, empty to disable")
+var strict = flag.Bool("strict", false, "Refuse pac files which fail to load or evaluate, at startup and on refresh")
+var testURLs = flag.String("test", "", "Print the proxies pac selects for each url in this file, - reads stdin, then exit without serving")
+var grace = flag.Duration("grace", 10*time.Second, "Grace period to wait for active connections on shutdown")
+
+func init() {
+	flag.Var(upstreamCreds, "upstream-auth", "Credentials for upstream http or socks5 proxy as host:user:pass or host:port:user:pass, can be repeated")
+	flag.Var(upstreamNTLM, "upstream-ntlm", `NTLM credentials for upstream proxy as host:domain\user:pass or host:port:domain\user:pass, can be repeated`)
+	flag.Var(connectSchemes, "connect-scheme", "Scheme of the url passed to pac for CONNECT to a port as port=scheme, eg: 21=ftp, *=tcp for ports not given, all are https by default, can be repeated")
+	flag.Var(&responseHeaders, "response-header", "Rewrite a header of responses as delete:Name, set:Name=value or append:Name=value, can be repeated")
+	flag.Var(&overrides, "override", "Proxy for hosts matching a glob instead of pac as glob=directive, eg: *.corp.com=DIRECT, can be repeated")
 }
 
-func removeHopHeaders(h http.Header) {
-	for _, k := range hopHeaders {
-		hv := h.Get(k)
-		if hv == "" {
-			continue
+// splitList splits comma separated s, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
-		if k == "Te" && hv == "trailers" {
-			continue
-		}
-		h.Del(k)
 	}
+	return items
 }
 
-// prune clean http header
-func prune(h http.Header) {
-	removeConnectionHeaders(h)
-	removeHopHeaders(h)
-}
-
-func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
-	host, port, _ := net.SplitHostPort(r.Host)
-	var url string
-
-	if port == "443" {
-		url = fmt.Sprintf("https://%s/", host)
-	} else {
-		url = fmt.Sprintf("https://%s:%s/", host, port)
-	}
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Parse()
 
-	proxies, err := s.pac.FindProxy(url)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	buildInfo := proxy.BuildInfo{Version: version, Commit: commit, Date: date, Go: runtime.Version()}
+	if *showVersion {
+		fmt.Printf("pacroxy %s (commit %s, built %s, %s)\n", buildInfo.Version, buildInfo.Commit, buildInfo.Date, buildInfo.Go)
 		return
 	}
 
-	ctx := context.Background()
-
-	var dst net.Conn
-	var proxy *gpac.Proxy
-
-	for _, proxy = range proxies {
-		dialer := proxy.Dialer()
-		dst, err = dialer(ctx, "tcp", r.Host)
-		if err != nil {
-			log.Println("Dial failed:", err)
-			continue
-		} else {
-			break
+	if *config != "" {
+		if err := loadConfig(*config); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-
-	if proxy == nil {
-		http.Error(w, "No Proxy Available", http.StatusServiceUnavailable)
-		return
-	}
+	// expanded after loadConfig so references in the config file work too
+	*pacfile = os.ExpandEnv(*pacfile)
+	*addr = os.ExpandEnv(*addr)
 
-	if proxy.IsDirect() || proxy.IsSOCKS() {
-		w.WriteHeader(http.StatusOK)
+	if *testURLs == "-" && strings.Contains(","+*pacfile+",", ",-,") {
+		log.Fatal("-p and -test can not both read stdin")
 	}
 
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
-	}
-
-	src, buf, err := hijacker.Hijack()
+	creds, err := proxy.LoadCredentials(*auth, *authFile)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+		log.Fatal(err)
 	}
 
-	src = combine(buf, src)
-
-	go pipe(dst, src)
-	go pipe(src, dst)
-
-	log.Printf("[%s] %s %v [%v]", r.RemoteAddr, r.Method, url, proxy)
-}
-
-func pipe(destination io.WriteCloser, source io.ReadCloser) {
-	defer destination.Close()
-	defer source.Close()
-	io.Copy(destination, source)
-}
-
-func (s *Server) handleHTTP(w http.ResponseWriter, req *http.Request) {
-	var perr error
-
-	proxies, err := s.pac.FindProxy(req.URL.String())
+	listeners, err := inheritListeners()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-
-	prune(req.Header)
-
-	for _, proxy := range proxies {
-		resp, err := proxy.Transport().RoundTrip(req)
-		perr = err
-		if err != nil {
-			continue
-		}
-
-		defer resp.Body.Close()
-		cloneHeader(w.Header(), resp.Header)
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
-
-		log.Printf("[%s] %s %v [%v]", req.RemoteAddr, req.Method, req.URL, proxy)
-
-		if err == nil {
-			return
-		}
+		log.Fatal(err)
 	}
 
-	if perr != nil {
-		log.Printf("[%s] %s %v FAILED: %v", req.RemoteAddr, req.Method, req.URL, perr)
-		http.Error(w, perr.Error(), http.StatusServiceUnavailable)
-	} else {
-		http.Error(w, "No proxy found", http.StatusServiceUnavailable)
+	server, err := proxy.New(proxy.Options{
+		Addr:                  *addr,
+		PacSource:             *pacfile,
+		WPAD:                  *wpad,
+		PacMerge:              *pacMerge,
+		PacURL:                *pacURL,
+		RefreshInterval:       *refresh,
+		FetchTimeout:          *timeout,
+		UserAgent:             *userAgent,
+		PacTimeout:            *pacTimeout,
+		DialTimeout:           *dialTimeout,
+		Retries:               *retries,
+		RetryBackoff:          *retryBackoff,
+		TunnelIdle:            *tunnelIdle,
+		ReadTimeout:           *readTimeout,
+		ResponseHeaderTimeout: *headerTimeout,
+		ReadHeaderTimeout:     *readHeaderTimeout,
+		KeepAlive:             *keepAlive,
+		ReusePort:             *reusePort,
+		FastOpen:              *fastOpen,
+		IdleConnTimeout:       *idleConnTimeout,
+		MaxIdleConns:          *maxIdleConns,
+		MaxHeaderBytes:        *maxHeaderBytes,
+		MaxBodyBytes:          *maxBodyBytes,
+		MaxClients:            *maxClients,
+		MetricsAddr:           *metricsAddr,
+		Listeners:             listeners,
+		MetricsRequired:       *metricsRequired,
+		SlowThreshold:         *slowThreshold,
+		LogFormat:             *logFormat,
+		HealthPath:            *healthPath,
+		PacPath:               *pacPath,
+		Credentials:           creds,
+		Allow:                 *allow,
+		ForceAllow:            *forceAllow,
+		RequestIDHeader:       *requestIDHeader,
+		ForceClients:          splitList(*forceClients),
+		NextHop:               *nextHop,
+		Overrides:             overrides,
+		NoProxy:               *noProxy,
+		ConnectPorts:          *connectPorts,
+		ConnectSchemes:        connectSchemes,
+		UpstreamAuth:          upstreamCreds,
+		UpstreamInsecure:      *upstreamInsecure,
+		UpstreamNTLM:          upstreamNTLM,
+		CacheSize:             *cacheSize,
+		IPVersion:             *ipVersion,
+		DNSCacheTTL:           *dnsCacheTTL,
+		CacheTTL:              *cacheTTL,
+		Via:                   *via,
+		StripHeaders:          splitList(*stripHeaders),
+		HopHeaders:            splitList(*hopHeaders),
+		ResponseHeaders:       responseHeaders,
+		NoXFF:                 *noXFF,
+		BlockMethods:          splitList(*blockMethods),
+		VerboseErrors:         *verboseErrors,
+		DirectFallback:        *directFallback,
+		BreakerThreshold:      *breakerThreshold,
+		BreakerCooldown:       *breakerCooldown,
+		SmartSelect:           *smartSelect,
+		RateLimit:             *rateLimit,
+		RateLimitShared:       *rateLimitShared,
+		MaxConnsPerProxy:      *maxConnsPerProxy,
+		ProxyLimitWait:        *proxyLimitWait,
+		Strict:                *strict,
+		TLSCert:               *tlsCert,
+		TLSKey:                *tlsKey,
+		DisableHTTP2:          *noHTTP2,
+		ClientCA:              *clientCA,
+		SocksAddr:             *socksAddr,
+		BuildInfo:             buildInfo,
+		OnReady:               notifyReady,
+		Logger:                log.New(os.Stderr, "", log.LstdFlags|log.Lshortfile),
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
-}
 
-func (s *Server) watch() {
-	for {
-		time.Sleep(s.refreshDuration)
-		log.Printf("Try reloading from %s", s.pacfile)
-		pac, err := gpac.From(s.pacfile)
-
-		if pac.Source() == s.pac.Source() {
-			log.Println("Pac file not changed")
-			continue
-		}
-
-		if err != nil {
-			log.Printf("Refresh pac failed: %v", err)
-		} else {
-			log.Println("Refresh pac succeeded")
+	if *testURLs != "" {
+		if err := runTest(server, *testURLs, os.Stdout); err != nil {
+			log.Fatal(err)
 		}
-
-		s.Lock()
-		s.pac = pac
-		s.Unlock()
+		return
 	}
-}
 
-// Start starts the proxy server
-func (s *Server) Start() error {
-	log.Printf("Start proxy on %s", s.Server.Addr)
-	if s.refreshDuration > 0 {
-		log.Printf("Start pac file watcher on: %s, refresh time: %v", s.pacfile, s.refreshDuration)
-		go s.watch()
-	}
-	s.Handler = http.HandlerFunc(s.handle)
-	return s.ListenAndServe()
-}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Start()
+	}()
 
-// New create the proxy server
-func New(addr string, pacf string, rintval time.Duration) (*Server, error) {
-	pac, err := gpac.From(pacf)
-	if os.IsNotExist(err) {
-		log.Print("Warn: using direct connection")
-		pac, _ = gpac.New(
-			`
-			function FindProxyForURL(url, host) {
-				return "DIRECT";
-			}			
-			`,
-		)
-	} else if err != nil {
-		return nil, err
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if handoffSignal != nil {
+		signal.Notify(sigc, handoffSignal)
 	}
 
-	return &Server{
-		Server: http.Server{
-			Addr: addr,
-		},
-		pac:             pac,
-		pacfile:         pacf,
-		refreshDuration: rintval,
-	}, nil
-}
-
-func cloneHeader(dst, src http.Header) {
-	for k, vv := range src {
-		for _, v := range vv {
-			dst.Add(k, v)
+loop:
+	for {
+		select {
+		case err := <-errc:
+			log.Fatal(err)
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				server.Reload()
+				continue
+			}
+			if sig == handoffSignal {
+				if err := handoff(server); err != nil {
+					log.Printf("Handoff failed, keep serving: %v", err)
+					continue
+				}
+				log.Printf("Draining for up to %v", *grace)
+				break loop
+			}
+			log.Printf("Received %v, shutting down", sig)
+			break loop
 		}
 	}
-}
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	flag.Parse()
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
 
-	server, err := New(*addr, *pacfile, *refresh)
-	if err != nil {
-		log.Fatal(err)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
 	}
-
-	log.Fatal(server.Start())
 }
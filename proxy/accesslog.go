@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/darren/gpac"
+)
+
+// accessRecord is a single access log entry emitted per request
+type accessRecord struct {
+	ID       string    `json:"request_id,omitempty"`
+	Time     time.Time `json:"timestamp"`
+	Remote   string    `json:"remote_addr"`
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	Proxy    string    `json:"proxy,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Sent     int64     `json:"bytes_sent"`
+	Received int64     `json:"bytes_received"`
+	Duration float64   `json:"duration_ms"`
+	Error    string    `json:"error,omitempty"`
+
+	// Client is the identity of the verified client certificate
+	Client string `json:"client,omitempty"`
+
+	// Authority is the host:port tunneled to, URL is then only
+	// what pac was asked for and assumes https whatever the port
+	Authority string `json:"authority,omitempty"`
+
+	// Attempts are the proxies tried for the request in order
+	Attempts []attempt `json:"attempts,omitempty"`
+
+	// BodyError is set when copying the response body failed
+	// after the response header was sent to the client
+	BodyError string `json:"body_error,omitempty"`
+
+	// setup is the time a tunnel took to be established,
+	// slow tunnels are judged by it instead of their lifetime
+	setup time.Duration
+}
+
+// remote is the client address, with its certificate identity if
+// verified and the request id which ties the log lines of a request
+func (rec *accessRecord) remote() string {
+	remote := rec.Remote
+	if rec.Client != "" {
+		remote += " " + rec.Client
+	}
+	if rec.ID != "" {
+		remote += " #" + rec.ID
+	}
+	return remote
+}
+
+// attempt is the result of trying a proxy, including its retries
+type attempt struct {
+	Proxy    string  `json:"proxy"`
+	Error    string  `json:"error,omitempty"`
+	Skipped  bool    `json:"skipped,omitempty"` // not tried for its breaker or connection limit
+	Duration float64 `json:"duration_ms"`
+}
+
+// attempt records the result of trying proxy since start
+func (rec *accessRecord) attempt(proxy *gpac.Proxy, err error, skipped bool, start time.Time) {
+	a := attempt{
+		Proxy:    proxy.String(),
+		Skipped:  skipped,
+		Duration: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	rec.Attempts = append(rec.Attempts, a)
+}
+
+// tried returns the proxies attempted
+func (rec *accessRecord) tried() []string {
+	proxies := make([]string, len(rec.Attempts))
+	for i, a := range rec.Attempts {
+		proxies[i] = a.Proxy
+	}
+	return proxies
+}
+
+// failover summarizes the attempts when any proxy failed or was
+// skipped, empty when the first one tried succeeded
+func (rec *accessRecord) failover() string {
+	if len(rec.Attempts) == 0 || (len(rec.Attempts) == 1 && rec.Attempts[0].Error == "") {
+		return ""
+	}
+
+	items := make([]string, len(rec.Attempts))
+	for i, a := range rec.Attempts {
+		switch {
+		case a.Skipped:
+			items[i] = fmt.Sprintf("[%s] skipped: %s", a.Proxy, a.Error)
+		case a.Error != "":
+			items[i] = fmt.Sprintf("[%s] failed after %.0fms: %s", a.Proxy, a.Duration, a.Error)
+		default:
+			items[i] = fmt.Sprintf("[%s] succeeded", a.Proxy)
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+// target is the tunneled host:port or else the requested url
+func (rec *accessRecord) target() string {
+	if rec.Authority != "" {
+		return rec.Authority
+	}
+	return rec.URL
+}
+
+// warnSlow warns about requests or tunnel setups slower than slowThreshold
+func (s *Server) warnSlow(rec *accessRecord, elapsed time.Duration) {
+	if s.slowThreshold <= 0 {
+		return
+	}
+
+	d := elapsed
+	if rec.setup > 0 {
+		d = rec.setup
+	}
+	if d < s.slowThreshold {
+		return
+	}
+
+	proxy := rec.Proxy
+	if proxy == "" {
+		proxy = "none"
+	}
+	s.logger.Printf("Warn: [%s] %s %v via [%s] slow: took %v", rec.remote(), rec.Method, rec.target(), proxy, d.Round(time.Millisecond))
+}
+
+// logRequest emits the access log for a finished request in text or json format
+func (s *Server) logRequest(rec *accessRecord, start time.Time) {
+	elapsed := time.Since(start)
+	rec.Time = start
+	rec.Duration = float64(elapsed) / float64(time.Millisecond)
+
+	s.warnSlow(rec, elapsed)
+	s.stats.record(rec)
+
+	if s.logFormat == "json" {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			s.logger.Printf("Marshal access log failed: %v", err)
+			return
+		}
+		s.accessLog.Write(append(b, '\n'))
+		return
+	}
+
+	if attempts := rec.failover(); attempts != "" {
+		s.logger.Printf("[%s] %s %v attempts: %s", rec.remote(), rec.Method, rec.target(), attempts)
+	}
+
+	d := elapsed.Round(time.Millisecond)
+	if rec.Error != "" {
+		s.logger.Printf("[%s] %s %v FAILED after %v: %v", rec.remote(), rec.Method, rec.target(), d, rec.Error)
+		return
+	}
+
+	var status string
+	if rec.Status != 0 {
+		status = fmt.Sprintf(" %d", rec.Status)
+	}
+
+	s.logger.Printf("[%s] %s %v [%v]%s sent %d bytes, received %d bytes in %v",
+		rec.remote(), rec.Method, rec.target(), rec.Proxy, status, rec.Sent, rec.Received, d)
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// allowList is the networks clients may connect from, empty allows all
+type allowList []*net.IPNet
+
+// parseAllowList parses comma separated CIDRs, a bare IP is treated as a single host
+func parseAllowList(s string) (allowList, error) {
+	var list allowList
+
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allow entry: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow entry: %v", err)
+		}
+		list = append(list, ipnet)
+	}
+
+	return list, nil
+}
+
+// fromUnix tests whether a client connected on the local address of a
+// unix socket, its peers have no IP to check and are left to the file
+// permissions of the socket
+func fromUnix(local net.Addr) bool {
+	return local != nil && local.Network() == "unix"
+}
+
+// allows tests whether remoteAddr in host:port form is in the list
+func (a allowList) allows(remoteAddr string) bool {
+	if len(a) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range a {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type reloadResult struct {
+	Result string `json:"result"` // changed, unchanged or error
+	Error  string `json:"error,omitempty"`
+}
+
+// handleReload reloads pac files on POST, when proxy credentials are
+// configured the same credentials are required as basic auth
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.auth.checkHeader(r.Header.Get("Authorization")) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pacroxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.logger.Printf("[%s] Reload requested", r.RemoteAddr)
+	changed, err := s.reload()
+
+	result := reloadResult{Result: "unchanged"}
+	if changed {
+		result.Result = "changed"
+	}
+	if err != nil {
+		result = reloadResult{Result: "error", Error: err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// BuildInfo identifies the running build, served on /version
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+	Go      string `json:"go"`
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.buildInfo)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Credentials maps user names to passwords for inbound proxy authentication
+type Credentials map[string]string
+
+// LoadCredentials builds credentials from a user:pass pair and/or
+// a file containing one user:pass per line, lines starting with # are ignored
+func LoadCredentials(auth string, file string) (Credentials, error) {
+	creds := make(Credentials)
+
+	if auth != "" {
+		if err := creds.add(auth); err != nil {
+			return nil, err
+		}
+	}
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := creds.add(line); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return creds, nil
+}
+
+func (c Credentials) add(pair string) error {
+	i := strings.IndexByte(pair, ':')
+	if i <= 0 {
+		return fmt.Errorf("invalid credential %q, want user:pass", pair)
+	}
+	c[pair[:i]] = pair[i+1:]
+	return nil
+}
+
+// check tests whether r carries valid Proxy-Authorization,
+// empty Credentials allow everyone
+func (c Credentials) check(r *http.Request) bool {
+	return c.checkHeader(r.Header.Get("Proxy-Authorization"))
+}
+
+// checkHeader tests the basic auth header value against the credentials
+func (c Credentials) checkHeader(auth string) bool {
+	if len(c) == 0 {
+		return true
+	}
+
+	user, pass, ok := parseBasicAuth(auth)
+	if !ok {
+		return false
+	}
+
+	want, found := c[user]
+	if !found {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+}
+
+// parseBasicAuth parses an HTTP Basic Authentication string
+// "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==" returns ("Aladdin", "open sesame", true)
+func parseBasicAuth(auth string) (user, pass string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return
+	}
+
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return
+	}
+
+	cs := string(b)
+	i := strings.IndexByte(cs, ':')
+	if i < 0 {
+		return
+	}
+	return cs[:i], cs[i+1:], true
+}
+
+func requireAuth(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", `Basic realm="pacroxy"`)
+	http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// maxReplayBody is the largest request body buffered so that it
+// can be sent again on retries and to the next proxy
+const maxReplayBody = 64 << 10
+
+// clientBody is a request body too large to buffer. Round trips do not
+// close it, so as long as nothing was read it can still go to the next proxy.
+type clientBody struct {
+	r    io.Reader
+	read int64
+	err  error // reading from the client failed
+}
+
+func (b *clientBody) Read(data []byte) (int, error) {
+	n, err := b.r.Read(data)
+	b.read += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// failed tests whether reading the body from the client failed
+func (b *clientBody) failed() bool {
+	return b != nil && b.err != nil
+}
+
+// Close leaves the body to http.Server, which closes it after the handler
+func (b *clientBody) Close() error {
+	return nil
+}
+
+// sent tests whether a round trip read from the body,
+// a nil *clientBody never was
+func (b *clientBody) sent() bool {
+	return b != nil && b.read > 0
+}
+
+// bufferBody makes the request body replayable: bodies up to
+// maxReplayBody are read into memory and req.GetBody is set, larger
+// ones are returned as a clientBody which can only be sent once.
+func bufferBody(req *http.Request) (*clientBody, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, maxReplayBody+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) <= maxReplayBody {
+		req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(buf)), nil
+		}
+		return nil, nil
+	}
+
+	body := &clientBody{r: io.MultiReader(bytes.NewReader(buf), req.Body)}
+	req.Body = body
+	return body, nil
+}
+
+// maxBodyReader tells whether reading the body failed at its limit
+type maxBodyReader struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+	err   error
+}
+
+func (r *maxBodyReader) Read(data []byte) (int, error) {
+	n, err := r.ReadCloser.Read(data)
+	r.read += int64(n)
+	if err != nil && err != io.EOF && r.read >= r.limit {
+		r.err = err
+	}
+	return n, err
+}
+
+// exceeded tests whether the body was longer than allowed,
+// a nil *maxBodyReader never is
+func (r *maxBodyReader) exceeded() bool {
+	return r != nil && r.err != nil
+}
+
+// limitBody limits the request body to maxBodyBytes with
+// http.MaxBytesReader. Bodies announced larger are refused at once,
+// chunked ones fail the round trip once they grow past the limit.
+func (s *Server) limitBody(w http.ResponseWriter, req *http.Request) (*maxBodyReader, bool) {
+	if s.maxBodyBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > s.maxBodyBytes {
+		return nil, false
+	}
+
+	body := &maxBodyReader{ReadCloser: http.MaxBytesReader(w, req.Body, s.maxBodyBytes), limit: s.maxBodyBytes}
+	req.Body = body
+	return body, true
+}
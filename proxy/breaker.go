@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/darren/gpac"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+type breakerState struct {
+	failures int
+	openedAt time.Time // zero while closed, reset when a probe is let through
+}
+
+// breakerStatus is the state of a proxy breaker reported on /stats
+type breakerStatus struct {
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+}
+
+// breakers are circuit breakers keyed by proxy. After threshold
+// consecutive failures a proxy is skipped for cooldown, then a single
+// request probes it: success closes the breaker, failure opens it again.
+// A probe which is never recorded, say the client went away, just lets
+// another one through after the next cooldown.
+// A nil *breakers allows every proxy.
+type breakers struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	states    map[string]*breakerState
+}
+
+func newBreakers(threshold int, cooldown time.Duration) *breakers {
+	return &breakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		states:    make(map[string]*breakerState),
+	}
+}
+
+// allow tests whether proxy may be tried, DIRECT is never skipped
+func (b *breakers) allow(proxy *gpac.Proxy) error {
+	if b == nil || proxy.IsDirect() {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	st, ok := b.states[proxy.String()]
+	if !ok || st.openedAt.IsZero() {
+		return nil
+	}
+
+	if time.Since(st.openedAt) < b.cooldown {
+		return &skipError{fmt.Errorf("%v: circuit open after %d failures", proxy, st.failures)}
+	}
+	st.openedAt = time.Now()
+	return nil
+}
+
+// record counts the result of trying proxy
+func (b *breakers) record(proxy *gpac.Proxy, err error) {
+	if b == nil || proxy.IsDirect() {
+		return
+	}
+
+	key := proxy.String()
+	b.Lock()
+	defer b.Unlock()
+
+	if err == nil {
+		delete(b.states, key)
+		return
+	}
+
+	st, ok := b.states[key]
+	if !ok {
+		st = new(breakerState)
+		b.states[key] = st
+	}
+	st.failures++
+	if st.failures >= b.threshold {
+		st.openedAt = time.Now()
+	}
+}
+
+// reset closes all breakers, proxies of a reloaded pac start afresh
+func (b *breakers) reset() {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	b.states = make(map[string]*breakerState)
+	b.Unlock()
+}
+
+// status reports proxies which failed since they last succeeded
+func (b *breakers) status() map[string]breakerStatus {
+	if b == nil {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	status := make(map[string]breakerStatus, len(b.states))
+	for key, st := range b.states {
+		state := breakerClosed
+		switch {
+		case st.openedAt.IsZero():
+		case time.Since(st.openedAt) >= b.cooldown:
+			state = breakerHalfOpen
+		default:
+			state = breakerOpen
+		}
+		status[key] = breakerStatus{State: state, Failures: st.failures, OpenedAt: st.openedAt}
+	}
+	return status
+}
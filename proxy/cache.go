@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"container/list"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/darren/gpac"
+)
+
+// proxyCache is an LRU cache of FindProxy results with a TTL
+type proxyCache struct {
+	sync.Mutex
+
+	size  int
+	ttl   time.Duration
+	gen   uint64 // bumped on every purge so stale results are not stored
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	proxies []*gpac.Proxy
+	expires time.Time
+}
+
+func newProxyCache(size int, ttl time.Duration) *proxyCache {
+	return &proxyCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// cacheKey returns the scheme and host of urlstr which are used as cache
+// key, pac files often pick proxies by scheme
+func cacheKey(urlstr string) string {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return urlstr
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (c *proxyCache) get(key string) ([]*gpac.Proxy, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+	return entry.proxies, true
+}
+
+// put stores proxies unless the cache has been purged since gen was read
+func (c *proxyCache) put(key string, proxies []*gpac.Proxy, gen uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.proxies = proxies
+		entry.expires = expires
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&cacheEntry{key, proxies, expires})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *proxyCache) generation() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.gen
+}
+
+func (c *proxyCache) purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.gen++
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
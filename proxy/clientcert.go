@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// clientCAConfig returns the tls config requiring client certificates
+// signed by the CAs in pem file path
+func clientCAConfig(path string) (*tls.Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("client ca: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("client ca: no certificate found in %s", path)
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// clientNames returns the common name and subject alternative names of the
+// verified client certificate of r, nil without one
+func clientNames(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	return names
+}
+
+// clientName is the identity of the verified client certificate of r
+// used in logs, empty without one
+func clientName(r *http.Request) string {
+	if names := clientNames(r); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
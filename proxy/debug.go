@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type debugPacResult struct {
+	URL     string   `json:"url"`
+	Proxies []string `json:"proxies"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// handleDebugPac reports the proxies found for the url query parameter,
+// it is served on the metrics listener only, never to proxy clients
+func (s *Server) handleDebugPac(w http.ResponseWriter, r *http.Request) {
+	urlstr := r.URL.Query().Get("url")
+	if urlstr == "" {
+		http.Error(w, "missing url parameter", http.StatusBadRequest)
+		return
+	}
+
+	result := debugPacResult{URL: urlstr, Proxies: []string{}}
+	proxies, err := s.findProxy(urlstr)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	for _, proxy := range proxies {
+		result.Proxies = append(result.Proxies, proxy.String())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// IP versions of direct connections
+const (
+	IPAuto = "auto"
+	IPv4   = "4"
+	IPv6   = "6"
+)
+
+// happyEyeballsDelay is how long the first address family is tried
+// alone before racing the other, see RFC 8305
+const happyEyeballsDelay = 300 * time.Millisecond
+
+var directDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// ipNetwork returns the network to dial for ipVersion
+func ipNetwork(ipVersion string) (string, error) {
+	switch ipVersion {
+	case "", IPAuto:
+		return "tcp", nil
+	case IPv4:
+		return "tcp4", nil
+	case IPv6:
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("unknown ip version: %s", ipVersion)
+}
+
+// dialDirect connects to address without proxy, restricted to the
+// configured ip version. net.Dialer races both address families itself,
+// the dns cache does the same with cached addresses.
+func (s *Server) dialDirect(ctx context.Context, network, address string) (net.Conn, error) {
+	if network == "tcp" {
+		network = s.ipNetwork
+	}
+	if s.dns != nil {
+		return s.dns.dial(ctx, s.dial, network, address)
+	}
+	return s.dial(ctx, network, address)
+}
+
+// filterAddrs keeps the ip addresses usable with network
+func filterAddrs(addrs []string, network string) []string {
+	if network == "tcp" {
+		return addrs
+	}
+
+	var kept []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if (ip.To4() != nil) == (network == "tcp4") {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
+
+// dialAddrs connects to port of addrs with dial, when addrs has both
+// address families the family of the first address gets a head start
+func dialAddrs(ctx context.Context, dial dialFunc, network string, addrs []string, port string) (net.Conn, error) {
+	if network != "tcp" || len(addrs) < 2 {
+		return dialSerial(ctx, dial, network, addrs, port)
+	}
+
+	var primaries, fallbacks []string
+	v4 := net.ParseIP(addrs[0]).To4() != nil
+	for _, addr := range addrs {
+		if (net.ParseIP(addr).To4() != nil) == v4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	if len(fallbacks) == 0 {
+		return dialSerial(ctx, dial, network, addrs, port)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, 2)
+	race := func(addrs []string) {
+		conn, err := dialSerial(ctx, dial, network, addrs, port)
+		results <- result{conn, err}
+	}
+
+	go race(primaries)
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	var err error
+	fallbackStarted := false
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// close the loser should it connect before cancel
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			if err == nil {
+				err = r.err
+			}
+		}
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			go race(fallbacks)
+		}
+	}
+	return nil, err
+}
+
+// dialSerial tries addrs one after another
+func dialSerial(ctx context.Context, dial dialFunc, network string, addrs []string, port string) (net.Conn, error) {
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dial(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
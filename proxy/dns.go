@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsNegativeTTL is the longest time a failed lookup is cached
+const dnsNegativeTTL = 5 * time.Second
+
+// dnsCacheSweep is the number of entries above which expired ones are dropped
+const dnsCacheSweep = 1024
+
+type dnsEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// dnsCache caches host lookups of direct connections for ttl
+type dnsCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]*dnsEntry
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		entries: make(map[string]*dnsEntry),
+	}
+}
+
+// lookup resolves host, not found errors are cached too but
+// for at most dnsNegativeTTL so new records are picked up soon
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	now := time.Now()
+	c.Lock()
+	e, ok := c.entries[host]
+	c.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, e.err
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+
+	ttl := c.ttl
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			// temporary failures and canceled lookups are not cached
+			return nil, err
+		}
+		if ttl > dnsNegativeTTL {
+			ttl = dnsNegativeTTL
+		}
+	}
+
+	c.Lock()
+	if len(c.entries) >= dnsCacheSweep {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[host] = &dnsEntry{addrs, err, now.Add(ttl)}
+	c.Unlock()
+
+	return addrs, err
+}
+
+// evict drops host so the next lookup resolves it again
+func (c *dnsCache) evict(host string) {
+	c.Lock()
+	delete(c.entries, host)
+	c.Unlock()
+}
+
+// dial connects to address with dial trying the cached addresses of its host,
+// when all of them fail the host is evicted so dead addresses are not kept
+func (c *dnsCache) dial(ctx context.Context, dial dialFunc, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs = filterAddrs(addrs, network)
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+
+	conn, err := dialAddrs(ctx, dial, network, addrs, port)
+	if err != nil && ctx.Err() == nil {
+		c.evict(host)
+	}
+	return conn, err
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/darren/gpac"
+)
+
+// drains are the proxies taken out of rotation on /drain, by proxy
+// with the time they were drained. They are kept until undrained or
+// pac changed.
+type drains struct {
+	sync.Mutex
+	proxies map[string]time.Time
+}
+
+func newDrains() *drains {
+	return &drains{proxies: make(map[string]time.Time)}
+}
+
+// allow tests whether proxy is not drained
+func (d *drains) allow(proxy *gpac.Proxy) error {
+	d.Lock()
+	_, drained := d.proxies[proxy.String()]
+	d.Unlock()
+
+	if drained {
+		return &skipError{fmt.Errorf("%v: drained", proxy)}
+	}
+	return nil
+}
+
+func (d *drains) drain(key string) {
+	d.Lock()
+	if _, ok := d.proxies[key]; !ok {
+		d.proxies[key] = time.Now()
+	}
+	d.Unlock()
+}
+
+// undrain puts proxy back, an empty key puts all back
+func (d *drains) undrain(key string) {
+	d.Lock()
+	if key == "" {
+		d.proxies = make(map[string]time.Time)
+	} else {
+		delete(d.proxies, key)
+	}
+	d.Unlock()
+}
+
+func (d *drains) reset() {
+	d.undrain("")
+}
+
+// status reports the drained proxies, nil if there are none
+func (d *drains) status() map[string]time.Time {
+	d.Lock()
+	defer d.Unlock()
+
+	if len(d.proxies) == 0 {
+		return nil
+	}
+	status := make(map[string]time.Time, len(d.proxies))
+	for key, at := range d.proxies {
+		status[key] = at
+	}
+	return status
+}
+
+// skip tests whether proxy is to be skipped for being drained or its breaker
+func (s *Server) skip(proxy *gpac.Proxy) error {
+	if err := s.drains.allow(proxy); err != nil {
+		return err
+	}
+	return s.breakers.allow(proxy)
+}
+
+// handleDrain lists the drained proxies on GET, drains the proxy
+// given as ?proxy=PROXY+host:port on POST and undrains it on DELETE,
+// DELETE without a proxy undrains all. Like /reload changes require
+// the proxy credentials if configured.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodDelete:
+		if !s.auth.checkHeader(r.Header.Get("Authorization")) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pacroxy"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		directive := r.FormValue("proxy")
+		if directive == "" && r.Method == http.MethodPost {
+			http.Error(w, "missing proxy", http.StatusBadRequest)
+			return
+		}
+
+		var key string
+		if directive != "" {
+			proxies := gpac.ParseProxy(directive)
+			if len(proxies) != 1 || !validProxies(proxies) {
+				http.Error(w, fmt.Sprintf("invalid proxy %q", directive), http.StatusBadRequest)
+				return
+			}
+			key = proxies[0].String()
+		}
+
+		if r.Method == http.MethodPost {
+			s.logger.Printf("[%s] Drain %s", r.RemoteAddr, key)
+			s.drains.drain(key)
+		} else if key == "" {
+			s.logger.Printf("[%s] Undrain all proxies", r.RemoteAddr)
+			s.drains.undrain(key)
+		} else {
+			s.logger.Printf("[%s] Undrain %s", r.RemoteAddr, key)
+			s.drains.undrain(key)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	drained := s.drains.status()
+	if drained == nil {
+		drained = make(map[string]time.Time)
+	}
+	json.NewEncoder(w).Encode(drained)
+}
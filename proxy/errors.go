@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors a request fails with, test for them with errors.Is, the
+// underlying error is wrapped
+var (
+	// ErrNoProxyAvailable tells that pac returned no proxies for the url
+	ErrNoProxyAvailable = errors.New("no proxy available")
+	// ErrPacEvaluation tells that evaluating FindProxyForURL failed
+	ErrPacEvaluation = errors.New("pac evaluation failed")
+	// ErrAllProxiesFailed tells that every proxy pac returned was tried
+	// or skipped without success, the last error is wrapped
+	ErrAllProxiesFailed = errors.New("all proxies failed")
+)
+
+// pacError is an error of evaluating pac for url
+type pacError struct {
+	url string
+	err error
+}
+
+func (e *pacError) Error() string {
+	return fmt.Sprintf("evaluate pac for %s: %v", e.url, e.err)
+}
+
+func (e *pacError) Unwrap() error {
+	return e.err
+}
+
+func (e *pacError) Is(target error) bool {
+	return target == ErrPacEvaluation
+}
+
+// attemptError is the last error of a request together with
+// all the proxies tried for it
+type attemptError struct {
+	proxies []string
+	err     error
+}
+
+func (e *attemptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *attemptError) Unwrap() error {
+	return e.err
+}
+
+func (e *attemptError) Is(target error) bool {
+	return target == ErrAllProxiesFailed
+}
+
+// skipError tells that a proxy was skipped without being tried,
+// because it is at its connection limit or its breaker is open
+type skipError struct {
+	err error
+}
+
+func (e *skipError) Error() string {
+	return e.err.Error()
+}
+
+// connectError tells that an http proxy answered CONNECT with status
+type connectError struct {
+	proxy   string
+	address string
+	code    int
+	status  string
+}
+
+func (e *connectError) Error() string {
+	return fmt.Sprintf("%s rejected CONNECT %s: %s", e.proxy, e.address, e.status)
+}
+
+// clientStatus is the status relayed to the client for the rejection.
+// 407 is about our credentials to the proxy, clients can do nothing
+// about it and would be prompted for theirs, so it becomes 502.
+func (e *connectError) clientStatus() int {
+	if e.code >= 400 && e.code < 600 && e.code != http.StatusProxyAuthRequired {
+		return e.code
+	}
+	return http.StatusBadGateway
+}
+
+// errorStatus is the status replied for err: 502 when the last proxy
+// tried failed or the status it rejected CONNECT with, 503 when none
+// could be tried as pac failed or found none or the proxies were skipped
+func errorStatus(err error) int {
+	var se *skipError
+	if !errors.Is(err, ErrAllProxiesFailed) || errors.As(err, &se) {
+		return http.StatusServiceUnavailable
+	}
+
+	var ce *connectError
+	if errors.As(err, &ce) {
+		return ce.clientStatus()
+	}
+	return http.StatusBadGateway
+}
+
+// proxyError replies code to the client, the error and the proxies tried
+// are only included with verbose errors so internals are not leaked
+func (s *Server) proxyError(w http.ResponseWriter, err error, code int) {
+	msg := http.StatusText(code)
+	var ce *connectError
+	if errors.As(err, &ce) {
+		msg += ": upstream proxy replied " + ce.status
+	}
+	if s.verboseErrors {
+		msg = err.Error()
+		var ae *attemptError
+		if errors.As(err, &ae) && len(ae.proxies) > 0 {
+			msg += " (tried " + strings.Join(ae.proxies, ", ") + ")"
+		}
+	}
+	http.Error(w, msg, code)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/darren/gpac"
+)
+
+// forceHeader carries a pac directive overriding pac for a request, it is
+// honored from forceAllow or forceClients clients only and never forwarded
+const forceHeader = "X-Pacroxy-Force"
+
+type forceKey struct{}
+
+// forceProxies parses the forceHeader of r, it returns r with the forced
+// proxies in its context or an error when the directive is invalid.
+// The header is removed whether honored or not.
+func (s *Server) forceProxies(r *http.Request) (*http.Request, error) {
+	directive := r.Header.Get(forceHeader)
+	r.Header.Del(forceHeader)
+	if directive == "" || !s.mayForce(r) {
+		return r, nil
+	}
+
+	proxies := gpac.ParseProxy(directive)
+	if len(proxies) == 0 || !validProxies(proxies) {
+		return nil, fmt.Errorf("invalid %s: %q", forceHeader, directive)
+	}
+
+	s.logger.Printf("[%s] %s %s forced via %s", remoteOf(r), r.Method, r.RequestURI, directive)
+	return r.WithContext(context.WithValue(r.Context(), forceKey{}, proxies)), nil
+}
+
+// validProxies tests whether proxies are all of a known type with an address
+func validProxies(proxies []*gpac.Proxy) bool {
+	for _, p := range proxies {
+		switch p.Type {
+		case "DIRECT":
+			continue
+		case "PROXY", "HTTP", "HTTPS", "SOCKS", "SOCKS4", "SOCKS5":
+			if p.Address != "" {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// mayForce tests whether the client of r is allowed to use forceHeader
+func (s *Server) mayForce(r *http.Request) bool {
+	if len(s.forceAllow) > 0 && s.forceAllow.allows(r.RemoteAddr) {
+		return true
+	}
+	for _, name := range clientNames(r) {
+		if s.forceClients[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the proxies for a request of ctx to url,
+// forced proxies take precedence over overrides and pac
+func (s *Server) route(ctx context.Context, url string) ([]*gpac.Proxy, error) {
+	if proxies, ok := ctx.Value(forceKey{}).([]*gpac.Proxy); ok {
+		return proxies, nil
+	}
+	return s.findProxy(url)
+}
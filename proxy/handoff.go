@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// bind returns the listener handed over for addr in Options.Listeners,
+// or else binds it with listen. Listeners are recorded for ListenerFiles.
+func (s *Server) bind(addr string, listen func() (net.Listener, error)) (net.Listener, error) {
+	s.Lock()
+	l, ok := s.inherited[addr]
+	delete(s.inherited, addr)
+	s.Unlock()
+
+	if !ok {
+		var err error
+		if l, err = listen(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.Lock()
+	s.listeners[addr] = l
+	s.Unlock()
+	return l, nil
+}
+
+// closeInherited closes the listeners handed over for addresses
+// which are not configured anymore
+func (s *Server) closeInherited() {
+	s.Lock()
+	defer s.Unlock()
+	for addr, l := range s.inherited {
+		s.logger.Printf("Closing inherited listener %s, it is not configured", addr)
+		l.Close()
+		delete(s.inherited, addr)
+	}
+}
+
+// ListenerFiles returns duplicates of the bound proxy, socks and metrics
+// listeners by address, for another process to take them over in
+// Options.Listeners while this one drains with Shutdown. Unix sockets
+// are not removed on Shutdown anymore as the other process serves them.
+func (s *Server) ListenerFiles() (map[string]*os.File, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	files := make(map[string]*os.File, len(s.listeners))
+	for addr, l := range s.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, fmt.Errorf("listener %s can not be handed over", addr)
+		}
+		f, err := fl.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("listener %s: %v", addr, err)
+		}
+		files[addr] = f
+	}
+
+	for _, l := range s.listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return files, nil
+}
+
+func closeFiles(files map[string]*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// keepAliveListener applies the keep-alive period to conns accepted by
+// inherited tcp listeners, which lost the net.ListenConfig they were made by
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if l.period < 0 {
+		conn.SetKeepAlive(false)
+	} else {
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(l.period)
+	}
+	return conn, nil
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestStartReady(t *testing.T) {
+	origin := newOrigin(t, "hello")
+	inherited := listen(t)
+	addr := inherited.Addr().String()
+
+	ready := make(chan struct{})
+	s := newTestProxy(t, Options{
+		Finder:    staticFinder("DIRECT"),
+		Addr:      addr,
+		Listeners: map[string]net.Listener{addr: inherited},
+		OnReady:   func() { close(ready) },
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+	defer s.Shutdown(context.Background())
+
+	select {
+	case <-ready:
+	case err := <-errc:
+		t.Fatalf("Start = %v before ready", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready after 5s")
+	}
+
+	// once ready the inherited listener is served
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}}
+	if code, body := get(t, client, origin.URL); code != http.StatusOK || body != "hello" {
+		t.Errorf("GET = %d %q, want 200 hello", code, body)
+	}
+}
+
+// a process taking over listeners which fails in Start must not report
+// ready, the previous process then keeps serving them
+func TestStartFailsBeforeReady(t *testing.T) {
+	busy := listen(t)
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"bad tls cert", Options{TLSCert: "testdata/missing.pem", TLSKey: "testdata/missing.key"}},
+		{"required metrics", Options{MetricsAddr: busy.Addr().String(), MetricsRequired: true}},
+	}
+
+	for _, tt := range tests {
+		inherited := listen(t)
+		addr := inherited.Addr().String()
+
+		ready := false
+		opts := tt.opts
+		opts.Finder = staticFinder("DIRECT")
+		opts.Addr = addr
+		opts.Listeners = map[string]net.Listener{addr: inherited}
+		opts.OnReady = func() { ready = true }
+		s := newTestProxy(t, opts)
+
+		if err := s.Start(); err == nil {
+			s.Shutdown(context.Background())
+			t.Errorf("%s: Start succeeded", tt.name)
+		}
+		if ready {
+			t.Errorf("%s: ready reported before Start failed", tt.name)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Copied from https://github.com/golang/go/blob/master/src/net/http/httputil/reverseproxy.go
+
+// Hop-by-hop headers. These are removed when sent to the backend.
+// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection", // non-standard, sent by some clients
+	"Te",               // canonicalized version of "TE"
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeConnectionHeaders removes hop-by-hop headers listed in the "Connection" header of h.
+// See RFC 7230, section 6.1
+func removeConnectionHeaders(h http.Header) {
+	if c := h.Get("Connection"); c != "" {
+		for _, f := range strings.Split(c, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, k := range hopHeaders {
+		hv := h.Get(k)
+		if hv == "" {
+			continue
+		}
+		if k == "Te" && hv == "trailers" {
+			continue
+		}
+		h.Del(k)
+	}
+}
+
+// headerHasToken tests whether the comma separated values of header name contain token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prune removes hop-by-hop headers of requests and responses,
+// the configured ones included
+func (s *Server) prune(h http.Header) {
+	removeConnectionHeaders(h)
+	removeHopHeaders(h)
+	for _, name := range s.hopHeaders {
+		h.Del(name)
+	}
+}
+
+// rewriteHeaders removes the configured headers from a pruned request,
+// appends the client to X-Forwarded-For and this proxy to its Via header,
+// see RFC 7230 section 5.7.1
+func (s *Server) rewriteHeaders(req *http.Request) {
+	for _, name := range s.stripHeaders {
+		req.Header.Del(name)
+	}
+
+	if !s.noXFF {
+		forwardedFor(req)
+	}
+
+	if s.via != "" {
+		via := fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, s.via)
+		if prior := req.Header["Via"]; len(prior) > 0 {
+			via = strings.Join(prior, ", ") + ", " + via
+		}
+		req.Header.Set("Via", via)
+	}
+}
+
+// forwardedFor appends the client ip to X-Forwarded-For and sets
+// X-Forwarded-Proto to the scheme the client connected with
+func forwardedFor(req *http.Request) {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := req.Header["X-Forwarded-For"]; len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
+
+func cloneHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestResponseHopHeadersRemoved(t *testing.T) {
+	origin := newOriginFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Connection", "X-Secret")
+		h.Set("X-Secret", "1")
+		h.Set("Keep-Alive", "timeout=5")
+		h.Set("Proxy-Authenticate", `Basic realm="origin"`)
+		h.Set("Proxy-Connection", "keep-alive")
+		h.Set("X-Hop", "1")
+		h.Set("X-Kept", "1")
+		w.Write([]byte("hello"))
+	})
+	_, ts := newTestServer(t, Options{Finder: staticFinder("DIRECT"), HopHeaders: []string{"X-Hop"}})
+
+	// read the raw response, clients may drop hop-by-hop headers themselves
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, name := range []string{"X-Secret", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection", "X-Hop"} {
+		if v, ok := resp.Header[name]; ok {
+			t.Errorf("hop-by-hop response header %s: %q forwarded", name, v)
+		}
+	}
+	if c := resp.Header.Get("Connection"); c != "" {
+		t.Errorf("Connection: %q forwarded", c)
+	}
+	if resp.Header.Get("X-Kept") != "1" {
+		t.Error("end-to-end header X-Kept removed")
+	}
+}
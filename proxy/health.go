@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type healthStatus struct {
+	PacLoaded   bool       `json:"pac_loaded"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// isHealthCheck tests whether r is a request to the health check endpoint.
+// Only origin-form requests (GET /healthz) qualify, proxy requests for
+// http://example.com/healthz always carry a host and are forwarded as usual.
+func (s *Server) isHealthCheck(r *http.Request) bool {
+	return s.healthPath != "" &&
+		r.Method == http.MethodGet &&
+		r.URL.Host == "" &&
+		r.URL.Path == s.healthPath
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	var status healthStatus
+
+	s.Lock()
+	loadedAt, reloadErr := s.loadedAt, s.reloadErr
+	s.Unlock()
+
+	if !loadedAt.IsZero() {
+		status.PacLoaded = true
+		status.LastRefresh = &loadedAt
+	}
+	// the proxy keeps serving with the pac loaded before, or direct
+	if reloadErr != nil {
+		status.LastError = reloadErr.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/darren/gpac"
+)
+
+// latencyWeight is the weight of the newest sample in the moving averages
+const latencyWeight = 0.3
+
+// failurePenalty is the least latency a failed attempt counts for,
+// failing fast does not make a proxy fast
+const failurePenalty = 5 * time.Second
+
+// minSuccess keeps a failing proxy comparable instead of dividing by zero
+const minSuccess = 0.05
+
+type latencyState struct {
+	latency float64 // seconds
+	success float64 // 1 when all recent attempts succeeded
+	samples int
+}
+
+// score is the expected time to succeed, lower is better
+func (st *latencyState) score() float64 {
+	success := st.success
+	if success < minSuccess {
+		success = minSuccess
+	}
+	return st.latency / success
+}
+
+// latencyStatus is the state of a proxy reported on /stats
+type latencyStatus struct {
+	Latency time.Duration `json:"latency"`
+	Success float64       `json:"success"`
+	Samples int           `json:"samples"`
+}
+
+// latencies track the exponentially weighted moving average of the
+// latency and success rate of proxies, which orders the candidates of a
+// request. A nil *latencies keeps the pac order.
+type latencies struct {
+	sync.Mutex
+	states map[string]*latencyState
+}
+
+func newLatencies() *latencies {
+	return &latencies{states: make(map[string]*latencyState)}
+}
+
+// record adds the result of an attempt through proxy which took d
+func (l *latencies) record(proxy *gpac.Proxy, err error, d time.Duration) {
+	if l == nil {
+		return
+	}
+
+	success := 1.0
+	if err != nil {
+		success = 0
+		if d < failurePenalty {
+			d = failurePenalty
+		}
+	}
+
+	key := proxy.String()
+	l.Lock()
+	defer l.Unlock()
+
+	st, ok := l.states[key]
+	if !ok {
+		l.states[key] = &latencyState{d.Seconds(), success, 1}
+		return
+	}
+	st.latency += latencyWeight * (d.Seconds() - st.latency)
+	st.success += latencyWeight * (success - st.success)
+	st.samples++
+}
+
+// sort returns proxies ordered by score, proxies not tried yet come
+// first so they get measured, ties keep the pac order
+func (l *latencies) sort(proxies []*gpac.Proxy) []*gpac.Proxy {
+	if l == nil || len(proxies) < 2 {
+		return proxies
+	}
+
+	scores := make(map[*gpac.Proxy]float64, len(proxies))
+	l.Lock()
+	for _, proxy := range proxies {
+		if st, ok := l.states[proxy.String()]; ok {
+			scores[proxy] = st.score()
+		}
+	}
+	l.Unlock()
+
+	// proxies may be shared with the cache, never sort in place
+	sorted := make([]*gpac.Proxy, len(proxies))
+	copy(sorted, proxies)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return scores[sorted[i]] < scores[sorted[j]]
+	})
+	return sorted
+}
+
+// reset forgets all samples, proxies of a reloaded pac start afresh
+func (l *latencies) reset() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	l.states = make(map[string]*latencyState)
+	l.Unlock()
+}
+
+// status reports the averages of the proxies tried
+func (l *latencies) status() map[string]latencyStatus {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	status := make(map[string]latencyStatus, len(l.states))
+	for key, st := range l.states {
+		status[key] = latencyStatus{
+			Latency: time.Duration(st.latency * float64(time.Second)),
+			Success: st.success,
+			Samples: st.samples,
+		}
+	}
+	return status
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/darren/gpac"
+)
+
+// acquire takes one of the connection slots of proxy, when all are taken
+// it waits at most limitWait for one to free up. DIRECT is not limited.
+// release must be called when the connection is done.
+func (s *Server) acquire(ctx context.Context, proxy *gpac.Proxy) (release func(), err error) {
+	if s.maxConnsPerProxy <= 0 || proxy.IsDirect() {
+		return func() {}, nil
+	}
+
+	key := proxy.String()
+	s.Lock()
+	sem, ok := s.conns[key]
+	if !ok {
+		sem = make(chan struct{}, s.maxConnsPerProxy)
+		s.conns[key] = sem
+	}
+	s.Unlock()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() { <-sem })
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if s.limitWait > 0 {
+		timer := time.NewTimer(s.limitWait)
+		defer timer.Stop()
+
+		select {
+		case sem <- struct{}{}:
+			return release, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil, &skipError{fmt.Errorf("%v: connection limit %d reached", proxy, s.maxConnsPerProxy)}
+}
+
+// releaseConn releases its connection slot when closed
+type releaseConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *releaseConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *releaseConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+// acquireClient takes a client slot without waiting, it reports false
+// when maxClients are handled already
+func (s *Server) acquireClient() bool {
+	if s.clients != nil {
+		select {
+		case s.clients <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	atomic.AddInt64(&s.stats.ActiveClients, 1)
+	return true
+}
+
+func (s *Server) releaseClient() {
+	atomic.AddInt64(&s.stats.ActiveClients, -1)
+	if s.clients != nil {
+		<-s.clients
+	}
+}
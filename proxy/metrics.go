@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the prometheus collectors of a Server
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests     *prometheus.CounterVec
+	proxyResults *prometheus.CounterVec
+	tunnelBytes  *prometheus.CounterVec
+	reloads      prometheus.Counter
+	reloadErrors prometheus.Counter
+	reloadFailed prometheus.Gauge
+	lastReload   prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pacroxy_requests_total",
+			Help: "Total requests received by method and kind (connect, socks or http).",
+		}, []string{"method", "kind"}),
+		proxyResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pacroxy_proxy_requests_total",
+			Help: "Requests forwarded per upstream proxy by result (success or failure).",
+		}, []string{"proxy", "result"}),
+		tunnelBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pacroxy_tunnel_bytes_total",
+			Help: "Bytes transferred in CONNECT tunnels by direction (sent or received).",
+		}, []string{"direction"}),
+		reloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pacroxy_pac_reloads_total",
+			Help: "Total successful pac reloads.",
+		}),
+		reloadErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pacroxy_pac_reload_errors_total",
+			Help: "Total failed pac reloads.",
+		}),
+		reloadFailed: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pacroxy_pac_reload_failed",
+			Help: "Whether the last load of pac files failed (1) or succeeded (0).",
+		}),
+		lastReload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pacroxy_pac_last_reload_success_timestamp_seconds",
+			Help: "Unix time all pac files last loaded successfully.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.proxyResults,
+		m.tunnelBytes,
+		m.reloads,
+		m.reloadErrors,
+		m.reloadFailed,
+		m.lastReload,
+	)
+	return m
+}
+
+func (m *metrics) request(method string) {
+	kind := "http"
+	switch method {
+	case http.MethodConnect:
+		kind = "connect"
+	case "SOCKS5":
+		kind = "socks"
+	}
+	m.requests.WithLabelValues(method, kind).Inc()
+}
+
+// proxyResult records the result of using proxy, the label is the
+// string representation of gpac.Proxy like "PROXY 127.0.0.1:8080"
+func (m *metrics) proxyResult(proxy string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.proxyResults.WithLabelValues(proxy, result).Inc()
+}
+
+func (m *metrics) tunnel(sent, received int64) {
+	m.tunnelBytes.WithLabelValues("sent").Add(float64(sent))
+	m.tunnelBytes.WithLabelValues("received").Add(float64(received))
+}
+
+func (m *metrics) reload(err error) {
+	if err != nil {
+		m.reloadErrors.Inc()
+	} else {
+		m.reloads.Inc()
+	}
+}
+
+// reloaded records the result of loading all pac files, unlike reload
+// which counts each pac file
+func (m *metrics) reloaded(err error) {
+	if err != nil {
+		m.reloadFailed.Set(1)
+		return
+	}
+	m.reloadFailed.Set(0)
+	m.lastReload.SetToCurrentTime()
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// listenMetrics binds the metrics listener. Unless metricsRequired the
+// proxy keeps running without it when binding fails, loudly.
+func (s *Server) listenMetrics() error {
+	l, err := s.bind(s.metricsAddr, func() (net.Listener, error) {
+		return net.Listen("tcp", s.metricsAddr)
+	})
+	if err != nil {
+		if s.metricsRequired {
+			return fmt.Errorf("metrics listener: %v", err)
+		}
+		s.logger.Printf("Error: metrics listener failed, running without metrics and admin endpoints: %v", err)
+		return nil
+	}
+
+	s.Lock()
+	s.admin = l
+	s.Unlock()
+
+	go s.serveMetrics(l)
+	return nil
+}
+
+func (s *Server) serveMetrics(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.handler())
+	mux.HandleFunc("/debug/pac", s.handleDebugPac)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/reload", s.handleReload)
+	mux.HandleFunc("/drain", s.handleDrain)
+	mux.HandleFunc("/version", s.handleVersion)
+
+	s.logger.Printf("Start metrics on %s", l.Addr())
+	err := http.Serve(l, mux)
+	s.logger.Printf("Metrics listener stopped: %v", err)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/darren/gpac"
+)
+
+// noProxy is a NO_PROXY like bypass list, hosts matching it are always
+// connected directly without consulting pac
+type noProxy struct {
+	all     bool
+	nets    []*net.IPNet
+	domains []noProxyDomain
+}
+
+// noProxyDomain matches a host and its subdomains, on port only if set
+type noProxyDomain struct {
+	domain string
+	port   string
+}
+
+var directProxies = gpac.ParseProxy("DIRECT")
+
+// parseNoProxy parses comma separated entries: * for all hosts, IPs or
+// CIDRs matching ip hosts, domains matching themselves and subdomains
+// where a leading dot is ignored, optionally restricted to a :port
+func parseNoProxy(s string) *noProxy {
+	np := new(noProxy)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			np.all = true
+			continue
+		}
+
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			np.nets = append(np.nets, ipnet)
+			continue
+		}
+		if ip := net.ParseIP(strings.Trim(entry, "[]")); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			np.nets = append(np.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		d := noProxyDomain{domain: entry}
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			d = noProxyDomain{domain: host, port: port}
+		}
+		d.domain = strings.TrimPrefix(d.domain, ".")
+		if d.domain != "" {
+			np.domains = append(np.domains, d)
+		}
+	}
+
+	if !np.all && len(np.nets) == 0 && len(np.domains) == 0 {
+		return nil
+	}
+	return np
+}
+
+// match tests whether the host of urlstr bypasses pac
+func (np *noProxy) match(urlstr string) bool {
+	if np == nil {
+		return false
+	}
+	if np.all {
+		return true
+	}
+
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipnet := range np.nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// default ports are left out of the urls passed to pac
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[u.Scheme]
+	}
+	for _, d := range np.domains {
+		if d.port != "" && d.port != port {
+			continue
+		}
+		if host == d.domain || strings.HasSuffix(host, "."+d.domain) {
+			return true
+		}
+	}
+	return false
+}
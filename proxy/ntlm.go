@@ -0,0 +1,430 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/darren/gpac"
+)
+
+// NTLMCredentials authenticate to an upstream proxy with NTLMv2
+type NTLMCredentials struct {
+	Domain   string
+	User     string
+	Password string
+}
+
+// UpstreamNTLM maps upstream proxy host or host:port to the NTLM
+// credentials used for it instead of UpstreamAuth
+type UpstreamNTLM map[string]NTLMCredentials
+
+// String implements flag.Value
+func (u UpstreamNTLM) String() string {
+	hosts := make([]string, 0, len(u))
+	for host := range u {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return strings.Join(hosts, ",")
+}
+
+// Set implements flag.Value, it parses host:domain\user:pass or
+// host:port:domain\user:pass, the domain may be left out
+func (u UpstreamNTLM) Set(v string) error {
+	parts := strings.SplitN(v, ":", 4)
+	if len(parts) == 4 && isPort(parts[1]) {
+		parts = []string{parts[0] + ":" + parts[1], parts[2], parts[3]}
+	} else {
+		parts = strings.SplitN(v, ":", 3)
+	}
+
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid upstream ntlm %q, want host:domain\\user:pass", v)
+	}
+
+	creds := NTLMCredentials{User: parts[1], Password: parts[2]}
+	if i := strings.IndexByte(creds.User, '\\'); i >= 0 {
+		creds.Domain, creds.User = creds.User[:i], creds.User[i+1:]
+	}
+	u[parts[0]] = creds
+	return nil
+}
+
+// lookup finds credentials for the proxy address, host:port match is
+// preferred over host only
+func (u UpstreamNTLM) lookup(address string) (NTLMCredentials, bool) {
+	if creds, ok := u[address]; ok {
+		return creds, true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return NTLMCredentials{}, false
+	}
+	creds, ok := u[host]
+	return creds, ok
+}
+
+// ntlmProxy returns the credentials for the http proxy p, if any
+func (s *Server) ntlmProxy(p *gpac.Proxy) (NTLMCredentials, bool) {
+	switch p.Type {
+	case "PROXY", "HTTP", "HTTPS":
+		return s.upstreamNTLM.lookup(p.Address)
+	}
+	return NTLMCredentials{}, false
+}
+
+// ntlmHandshake authenticates req to the proxy on conn. NTLM authenticates
+// the connection, so negotiate and authenticate are sent with req on the
+// same conn and the response to the final one is returned. When the proxy
+// does not ask for NTLM its response to the first request is returned.
+// req must have GetBody set if it has a body.
+func ntlmHandshake(conn net.Conn, br *bufio.Reader, req *http.Request, creds NTLMCredentials) (*http.Response, error) {
+	negotiate := ntlmNegotiate()
+	resp, err := ntlmSend(conn, br, req, negotiate)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, ok := ntlmChallenge(resp)
+	if !ok {
+		return resp, nil
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.Close {
+		return nil, errors.New("proxy closed the connection during ntlm handshake")
+	}
+
+	authenticate, err := ntlmAuthenticate(challenge, creds)
+	if err != nil {
+		return nil, err
+	}
+	return ntlmSend(conn, br, req, authenticate)
+}
+
+func ntlmSend(conn net.Conn, br *bufio.Reader, req *http.Request, msg []byte) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	out.Header.Set("Proxy-Authorization", "NTLM "+base64.StdEncoding.EncodeToString(msg))
+
+	var err error
+	if out.Method == http.MethodConnect {
+		err = out.Write(conn)
+	} else {
+		err = out.WriteProxy(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(br, out)
+}
+
+// ntlmChallenge extracts the challenge message of a 407 response
+func ntlmChallenge(resp *http.Response) ([]byte, bool) {
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		return nil, false
+	}
+	for _, v := range resp.Header["Proxy-Authenticate"] {
+		if len(v) > 5 && strings.EqualFold(v[:5], "NTLM ") {
+			msg, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[5:]))
+			return msg, err == nil
+		}
+	}
+	return nil, false
+}
+
+// ntlmTransport sends http requests through an NTLM authenticated proxy.
+// Every request gets its own conn authenticated for it, which is closed
+// with the response body. Request bodies are buffered in memory as they
+// have to be sent twice.
+type ntlmTransport struct {
+	proxy *gpac.Proxy
+	creds NTLMCredentials
+	dial  dialFunc
+}
+
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if req.Body != nil && req.GetBody == nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(ctx)
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	conn, err := t.dial(ctx, "tcp", t.proxy.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ntlmConn{Conn: conn, stop: make(chan struct{})}
+	go c.closeOnDone(ctx)
+
+	resp, err := ntlmHandshake(conn, bufio.NewReader(conn), req, t.creds)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body = &ntlmBody{resp.Body, c}
+	return resp, nil
+}
+
+// CloseIdleConnections does nothing, conns are never reused
+func (t *ntlmTransport) CloseIdleConnections() {}
+
+// ntlmConn is closed when the request context is done
+type ntlmConn struct {
+	net.Conn
+	stop chan struct{}
+	once sync.Once
+}
+
+func (c *ntlmConn) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		c.Conn.Close()
+	case <-c.stop:
+	}
+}
+
+func (c *ntlmConn) Close() error {
+	c.once.Do(func() { close(c.stop) })
+	return c.Conn.Close()
+}
+
+// ntlmBody closes the conn along with the body
+type ntlmBody struct {
+	io.ReadCloser
+	conn *ntlmConn
+}
+
+func (b *ntlmBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// NTLM messages, see MS-NLMP section 2.2
+const (
+	ntlmNegotiateUnicode    = 0x00000001
+	ntlmRequestTarget       = 0x00000004
+	ntlmNegotiateNTLM       = 0x00000200
+	ntlmAlwaysSign          = 0x00008000
+	ntlmExtendedSecurity    = 0x00080000
+	ntlmNegotiateTargetInfo = 0x00800000
+	ntlmNegotiateVersion    = 0x02000000
+	ntlmNegotiate128        = 0x20000000
+	ntlmKeyExchange         = 0x40000000
+	ntlmNegotiate56         = 0x80000000
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+func ntlmNegotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateUnicode|ntlmRequestTarget|ntlmNegotiateNTLM|
+		ntlmAlwaysSign|ntlmExtendedSecurity|ntlmNegotiateTargetInfo|ntlmNegotiate128|ntlmNegotiate56)
+	return msg
+}
+
+// ntlmField returns the payload referenced by the field at offset of msg
+func ntlmField(msg []byte, offset int) ([]byte, error) {
+	n := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if start+n > len(msg) {
+		return nil, errors.New("ntlm field out of range")
+	}
+	return msg[start : start+n], nil
+}
+
+// ntlmAuthenticate answers challenge with an NTLMv2 response
+func ntlmAuthenticate(challenge []byte, creds NTLMCredentials) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("invalid ntlm challenge")
+	}
+
+	flags := binary.LittleEndian.Uint32(challenge[20:])
+	serverChallenge := challenge[24:32]
+	targetInfo, err := ntlmField(challenge, 40)
+	if err != nil {
+		return nil, err
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	timestamp, fromServer := ntlmTimestamp(targetInfo)
+	key := ntowfv2(creds)
+	nt := ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo)
+
+	// with a server timestamp the lm response should be left empty
+	lm := make([]byte, 24)
+	if !fromServer {
+		lm = lmv2Response(key, serverChallenge, clientChallenge)
+	}
+
+	payloads := [][]byte{lm, nt, utf16le(creds.Domain), utf16le(creds.User), nil, nil}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, p := range payloads {
+		field := msg[12+8*i:]
+		binary.LittleEndian.PutUint16(field, uint16(len(p)))
+		binary.LittleEndian.PutUint16(field[2:], uint16(len(p)))
+		binary.LittleEndian.PutUint32(field[4:], uint32(len(msg)))
+		msg = append(msg, p...)
+	}
+	// no session key is exchanged and no version sent
+	binary.LittleEndian.PutUint32(msg[60:], flags&^(ntlmKeyExchange|ntlmNegotiateVersion))
+	return msg, nil
+}
+
+// ntlmTimestamp returns the MsvAvTimestamp of targetInfo or else the
+// current time, as FILETIME
+func ntlmTimestamp(targetInfo []byte) ([]byte, bool) {
+	for av := targetInfo; len(av) >= 4; {
+		id := binary.LittleEndian.Uint16(av)
+		n := int(binary.LittleEndian.Uint16(av[2:]))
+		if id == ntlmAvEOL || len(av) < 4+n {
+			break
+		}
+		if id == ntlmAvTimestamp && n == 8 {
+			return av[4:12], true
+		}
+		av = av[4+n:]
+	}
+
+	// 100ns intervals since 1601-01-01
+	ft := uint64(time.Now().UnixNano()/100) + 116444736000000000
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, ft)
+	return timestamp, false
+}
+
+func ntowfv2(creds NTLMCredentials) []byte {
+	h := hmac.New(md5.New, md4(utf16le(creds.Password)))
+	h.Write(utf16le(strings.ToUpper(creds.User) + creds.Domain))
+	return h.Sum(nil)
+}
+
+func ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo []byte) []byte {
+	var temp []byte
+	temp = append(temp, 1, 1, 0, 0, 0, 0, 0, 0)
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	h := hmac.New(md5.New, key)
+	h.Write(serverChallenge)
+	h.Write(temp)
+	return append(h.Sum(nil), temp...)
+}
+
+func lmv2Response(key, serverChallenge, clientChallenge []byte) []byte {
+	h := hmac.New(md5.New, key)
+	h.Write(serverChallenge)
+	h.Write(clientChallenge)
+	return append(h.Sum(nil), clientChallenge...)
+}
+
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// md4 implements RFC 1320, the standard library has no md4 and NTLM
+// keys are md4 hashes of the password
+func md4(data []byte) []byte {
+	n := len(data)
+	msg := append(append([]byte(nil), data...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(n)<<3)
+	msg = append(msg, length[:]...)
+
+	rotl := func(x uint32, s uint) uint32 { return x<<s | x>>(32-s) }
+	rounds := []struct {
+		f     func(x, y, z uint32) uint32
+		k     uint32
+		order [16]int
+		shift [4]uint
+	}{
+		{func(x, y, z uint32) uint32 { return x&y | ^x&z }, 0,
+			[16]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, [4]uint{3, 7, 11, 19}},
+		{func(x, y, z uint32) uint32 { return x&y | x&z | y&z }, 0x5a827999,
+			[16]int{0, 4, 8, 12, 1, 5, 9, 13, 2, 6, 10, 14, 3, 7, 11, 15}, [4]uint{3, 5, 9, 13}},
+		{func(x, y, z uint32) uint32 { return x ^ y ^ z }, 0x6ed9eba1,
+			[16]int{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15}, [4]uint{3, 9, 11, 15}},
+	}
+
+	h := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	var x [16]uint32
+	for block := msg; len(block) > 0; block = block[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(block[4*i:])
+		}
+
+		a, b, c, d := h[0], h[1], h[2], h[3]
+		for _, r := range rounds {
+			for i, k := range r.order {
+				t := rotl(a+r.f(b, c, d)+x[k]+r.k, r.shift[i%4])
+				a, b, c, d = d, t, b, c
+			}
+		}
+		h[0] += a
+		h[1] += b
+		h[2] += c
+		h[3] += d
+	}
+
+	sum := make([]byte, 16)
+	for i, v := range h {
+		binary.LittleEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// test suite of RFC 1320 appendix A.5
+func TestMD4(t *testing.T) {
+	tests := []struct {
+		in, sum string
+	}{
+		{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{"a", "bde52cb31de33e46245e05fbdbd6fb24"},
+		{"abc", "a448017aaf21d8525fc10ae87aa6729d"},
+		{"message digest", "d9130a8164549fe818874806e1c7014b"},
+		{"abcdefghijklmnopqrstuvwxyz", "d79e1c308aa5bbcdeea8ed63df412da9"},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", "043f8582f241db351ce627e153e7f0e4"},
+		{"12345678901234567890123456789012345678901234567890123456789012345678901234567890", "e33b4ddc9c38f2199c3e7b164fcc0536"},
+	}
+
+	for _, tt := range tests {
+		if sum := hex.EncodeToString(md4([]byte(tt.in))); sum != tt.sum {
+			t.Errorf("md4(%q) = %s, want %s", tt.in, sum, tt.sum)
+		}
+	}
+}
+
+// ntlmTargetInfo is the AV_PAIR list of the MS-NLMP 4.2.4 example:
+// the Domain domain and Server computer names and MsvAvEOL
+const ntlmTargetInfo = "02000c0044006f006d00610069006e00" + "01000c00530065007200760065007200" + "00000000"
+
+// NTLMv2 authentication example of MS-NLMP section 4.2.4
+func TestNTLMv2(t *testing.T) {
+	creds := NTLMCredentials{Domain: "Domain", User: "User", Password: "Password"}
+	serverChallenge := unhex(t, "0123456789abcdef")
+	clientChallenge := unhex(t, "aaaaaaaaaaaaaaaa")
+	timestamp := make([]byte, 8)
+	targetInfo := unhex(t, ntlmTargetInfo)
+
+	if got, want := md4(utf16le(creds.Password)), unhex(t, "a4f49c406510bdcab6824ee7c30fd852"); !bytes.Equal(got, want) {
+		t.Errorf("NTOWFv1 = %x, want %x", got, want)
+	}
+
+	key := ntowfv2(creds)
+	if want := unhex(t, "0c868a403bfd7a93a3001ef22ef02e3f"); !bytes.Equal(key, want) {
+		t.Fatalf("NTOWFv2 = %x, want %x", key, want)
+	}
+
+	nt := ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo)
+	if want := unhex(t, "68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(nt[:16], want) {
+		t.Errorf("NTProofStr = %x, want %x", nt[:16], want)
+	}
+
+	lm := lmv2Response(key, serverChallenge, clientChallenge)
+	if want := unhex(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"); !bytes.Equal(lm, want) {
+		t.Errorf("LMv2 response = %x, want %x", lm, want)
+	}
+}
+
+func TestNTLMAuthenticate(t *testing.T) {
+	creds := NTLMCredentials{Domain: "Domain", User: "User", Password: "Password"}
+	serverChallenge := unhex(t, "0123456789abcdef")
+	targetInfo := unhex(t, ntlmTargetInfo)
+
+	// CHALLENGE_MESSAGE with an empty target name
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	binary.LittleEndian.PutUint32(challenge[12:], 48)
+	binary.LittleEndian.PutUint32(challenge[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateTargetInfo|ntlmKeyExchange)
+	copy(challenge[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(challenge[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(challenge[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	challenge = append(challenge, targetInfo...)
+
+	msg, err := ntlmAuthenticate(challenge, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		t.Fatalf("not an AUTHENTICATE_MESSAGE: %x", msg[:12])
+	}
+
+	field := func(i int) []byte {
+		b, err := ntlmField(msg, 12+8*i)
+		if err != nil {
+			t.Fatalf("field %d: %v", i, err)
+		}
+		return b
+	}
+	if domain := field(2); !bytes.Equal(domain, utf16le("Domain")) {
+		t.Errorf("domain = %x, want Domain", domain)
+	}
+	if user := field(3); !bytes.Equal(user, utf16le("User")) {
+		t.Errorf("user = %x, want User", user)
+	}
+	if flags := binary.LittleEndian.Uint32(msg[60:]); flags&ntlmKeyExchange != 0 {
+		t.Errorf("flags %#x ask for a key exchange", flags)
+	}
+
+	// the NTProofStr verifies against the random client challenge sent
+	nt := field(1)
+	if len(nt) < 16+28+len(targetInfo) {
+		t.Fatalf("NTLMv2 response of %d bytes is too short", len(nt))
+	}
+	temp := nt[16:]
+	if !bytes.Equal(temp[28:28+len(targetInfo)], targetInfo) {
+		t.Errorf("NTLMv2 response does not carry the target info")
+	}
+	h := hmac.New(md5.New, ntowfv2(creds))
+	h.Write(serverChallenge)
+	h.Write(temp)
+	if !hmac.Equal(h.Sum(nil), nt[:16]) {
+		t.Error("NTProofStr does not verify")
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/darren/gpac"
+)
+
+type override struct {
+	pattern string
+	proxies []*gpac.Proxy
+}
+
+// Overrides maps host globs to proxies used instead of the pac result,
+// the first matching glob wins
+type Overrides []override
+
+// String implements flag.Value
+func (o *Overrides) String() string {
+	if o == nil {
+		return ""
+	}
+	var items []string
+	for _, e := range *o {
+		var directives []string
+		for _, p := range e.proxies {
+			directives = append(directives, p.String())
+		}
+		items = append(items, e.pattern+"="+strings.Join(directives, "; "))
+	}
+	return strings.Join(items, ",")
+}
+
+// Set implements flag.Value, it parses glob=directive like
+// *.example.com=DIRECT or intranet=PROXY 10.0.0.1:8080; DIRECT
+func (o *Overrides) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid override %q, want glob=directive", v)
+	}
+
+	pattern := strings.ToLower(strings.TrimSpace(v[:i]))
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid override %q: %v", v, err)
+	}
+
+	proxies := gpac.ParseProxy(v[i+1:])
+	if len(proxies) == 0 {
+		return fmt.Errorf("invalid override %q, no proxy given", v)
+	}
+
+	*o = append(*o, override{pattern, proxies})
+	return nil
+}
+
+// match returns the proxies of the first glob matching the host of urlstr
+func (o Overrides) match(urlstr string) ([]*gpac.Proxy, bool) {
+	if len(o) == 0 {
+		return nil, false
+	}
+
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return nil, false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	for _, e := range o {
+		if ok, _ := path.Match(e.pattern, host); ok {
+			return e.proxies, true
+		}
+	}
+	return nil, false
+}
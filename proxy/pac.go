@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darren/gpac"
+)
+
+// loadPac loads the pac of source within timeout, 0 means no timeout
+func loadPac(source Source, timeout time.Duration) (*gpac.Parser, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	text, err := source.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return gpac.New(text)
+}
+
+// forget makes source load its pac again even if unchanged,
+// so a pac which failed is not taken as loaded next time
+func forget(source Source) {
+	if r, ok := source.(resetter); ok {
+		r.reset()
+	}
+}
+
+func directPac() *gpac.Parser {
+	pac, _ := gpac.New(
+		`
+		function FindProxyForURL(url, host) {
+			return "DIRECT";
+		}
+		`,
+	)
+	return pac
+}
+
+// sanityURLs are evaluated to validate a pac
+var sanityURLs = []string{
+	"http://example.com/",
+	"https://example.com/",
+}
+
+// validatePac checks that FindProxyForURL evaluates within timeout without
+// throwing and returns a non empty result for sanityURLs
+func validatePac(pac *gpac.Parser, timeout time.Duration) error {
+	for _, u := range sanityURLs {
+		proxies, err := evalPac(pac, u, timeout)
+		if err != nil {
+			return fmt.Errorf("evaluate FindProxyForURL(%s): %v", u, err)
+		}
+		if len(proxies) == 0 {
+			return fmt.Errorf("evaluate FindProxyForURL(%s): no proxy returned", u)
+		}
+	}
+	return nil
+}
+
+// Strategies to merge results of multiple pac files
+const (
+	// MergeFirst uses the result of the first pac that returns a non-DIRECT proxy
+	MergeFirst = "first"
+	// MergeConcat concatenates results of all pacs in order
+	MergeConcat = "concat"
+)
+
+// splitSources splits comma separated pac sources
+func splitSources(src string) []string {
+	var sources []string
+	for _, s := range strings.Split(src, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			sources = append(sources, s)
+		}
+	}
+	if len(sources) == 0 {
+		// keep a source so the server falls back to direct connection
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// hungPacs are the parsers whose evaluation timed out. gpac has no way
+// to interrupt a script, it keeps running and holding the parser lock,
+// so they fail at once from then on until a reload replaces them.
+var hungPacs sync.Map
+
+func isHung(pac *gpac.Parser) bool {
+	_, hung := hungPacs.Load(pac)
+	return hung
+}
+
+// evalPac runs FindProxy of pac, failing when it takes longer than
+// timeout, 0 means no timeout
+func evalPac(pac *gpac.Parser, urlstr string, timeout time.Duration) ([]*gpac.Proxy, error) {
+	if timeout <= 0 {
+		return pac.FindProxy(urlstr)
+	}
+	if isHung(pac) {
+		return nil, errors.New("pac evaluation timed out before, waiting for reload")
+	}
+
+	type result struct {
+		proxies []*gpac.Proxy
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// nothing recovers panics of this goroutine but here
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{nil, fmt.Errorf("pac panic: %v", p)}
+			}
+		}()
+		proxies, err := pac.FindProxy(urlstr)
+		done <- result{proxies, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.proxies, r.err
+	case <-timer.C:
+		hungPacs.Store(pac, true)
+		return nil, fmt.Errorf("pac evaluation of %s timed out after %v", urlstr, timeout)
+	}
+}
+
+// PacFinder finds the proxies for an url like FindProxyForURL of a pac,
+// *gpac.Parser implements it
+type PacFinder interface {
+	FindProxy(urlstr string) ([]*gpac.Proxy, error)
+}
+
+var _ PacFinder = (*gpac.Parser)(nil)
+
+// evalPacs consults pacs in order and merges the results according to merge,
+// it fails when no pac returned any proxy
+func evalPacs(pacs []*gpac.Parser, merge string, urlstr string, timeout time.Duration) ([]*gpac.Proxy, error) {
+	var result []*gpac.Proxy
+	seen := make(map[string]bool)
+
+	for _, pac := range pacs {
+		proxies, err := evalPac(pac, urlstr, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		if merge == MergeConcat {
+			for _, proxy := range proxies {
+				if key := proxy.String(); !seen[key] {
+					seen[key] = true
+					result = append(result, proxy)
+				}
+			}
+			continue
+		}
+
+		// an empty result does not replace DIRECT of an earlier pac
+		if len(proxies) > 0 {
+			result = proxies
+		}
+		if !allDirect(proxies) {
+			break
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoProxyAvailable, urlstr)
+	}
+	return result, nil
+}
+
+func allDirect(proxies []*gpac.Proxy) bool {
+	for _, proxy := range proxies {
+		if !proxy.IsDirect() {
+			return false
+		}
+	}
+	return true
+}
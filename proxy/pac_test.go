@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memorySource serves a pac text which can be swapped
+type memorySource struct {
+	sync.Mutex
+	pac string
+}
+
+func (m *memorySource) Load(ctx context.Context) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.pac, nil
+}
+
+func (m *memorySource) String() string {
+	return "memory"
+}
+
+func (m *memorySource) set(directive string) {
+	m.Lock()
+	m.pac = `function FindProxyForURL(url, host) { return "` + directive + `"; }`
+	m.Unlock()
+}
+
+func TestReloadDuringRequest(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	origin := newOrigin(t, "hello")
+	slow := newOriginFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.Write([]byte("slow"))
+	})
+	up := newUpstream(t)
+
+	source := new(memorySource)
+	source.set("PROXY " + up.addr)
+	s, ts := newTestServer(t, Options{PacSources: []Source{source}})
+	client := proxyClient(t, ts)
+
+	done := make(chan string)
+	go func() {
+		resp, err := client.Get(slow.URL)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		resp.Body.Close()
+		done <- resp.Status
+	}()
+
+	// reload while the request is waiting for the origin, others
+	// evaluate the pac concurrently
+	<-entered
+	source.set("DIRECT")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.FindProxy(origin.URL)
+		}()
+	}
+	if err := s.Reload(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+	close(release)
+
+	if status := <-done; status != "200 OK" {
+		t.Fatalf("request in flight during reload = %s, want 200 OK", status)
+	}
+	if up.count() != 1 {
+		t.Fatalf("upstream got %d requests, want the one in flight", up.count())
+	}
+
+	// requests started after the reload take the new pac
+	if code, body := get(t, client, origin.URL); code != http.StatusOK || body != "hello" {
+		t.Errorf("GET after reload = %d %q, want 200 hello", code, body)
+	}
+	if up.count() != 1 {
+		t.Errorf("upstream got %d requests, want DIRECT after reload", up.count())
+	}
+}
+
+func TestPacReturnsEmpty(t *testing.T) {
+	origin := newOrigin(t, "hello")
+
+	empty := new(memorySource)
+	empty.pac = `function FindProxyForURL(url, host) { return ""; }`
+	s, ts := newTestServer(t, Options{PacSources: []Source{empty}, VerboseErrors: true})
+
+	if _, err := s.FindProxy(origin.URL); !errors.Is(err, ErrNoProxyAvailable) {
+		t.Errorf("FindProxy = %v, want ErrNoProxyAvailable", err)
+	}
+	code, body := get(t, proxyClient(t, ts), origin.URL)
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "no proxy available for "+origin.URL) {
+		t.Errorf("GET = %d %q, want 503 no proxy available", code, body)
+	}
+
+	// a later pac answers for an empty one
+	direct := new(memorySource)
+	direct.set("DIRECT")
+	_, ts = newTestServer(t, Options{PacSources: []Source{empty, direct}})
+	if code, body := get(t, proxyClient(t, ts), origin.URL); code != http.StatusOK || body != "hello" {
+		t.Errorf("GET with a second pac = %d %q, want 200 hello", code, body)
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type portRange struct {
+	lo, hi int
+}
+
+// portList are the ports CONNECT and socks5 may tunnel to,
+// a nil portList allows all
+type portList []portRange
+
+// parsePortList parses comma separated ports and lo-hi ranges,
+// empty or all allows all ports
+func parsePortList(s string) (portList, error) {
+	if s = strings.TrimSpace(s); s == "" || strings.EqualFold(s, "all") {
+		return nil, nil
+	}
+
+	var ports portList
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		lo, hi := item, item
+		if i := strings.IndexByte(item, '-'); i >= 0 {
+			lo, hi = item[:i], item[i+1:]
+		}
+		r, err := parsePortRange(lo, hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connect port %q", item)
+		}
+		ports = append(ports, r)
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("invalid connect ports %q", s)
+	}
+	return ports, nil
+}
+
+func parsePortRange(lo, hi string) (portRange, error) {
+	l, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return portRange{}, err
+	}
+	h, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return portRange{}, err
+	}
+	if l < 1 || h > 65535 || l > h {
+		return portRange{}, fmt.Errorf("port out of range")
+	}
+	return portRange{l, h}, nil
+}
+
+// allows tests whether the port of hostport is in the list
+func (p portList) allows(hostport string) bool {
+	if p == nil {
+		return true
+	}
+
+	_, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, r := range p {
+		if n >= r.lo && n <= r.hi {
+			return true
+		}
+	}
+	return false
+}
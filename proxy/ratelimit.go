@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// limiter returns the limiter for a new connection, the shared one
+// if configured so, nil when rate limiting is disabled
+func (s *Server) limiter() *rate.Limiter {
+	if s.rateLimit <= 0 {
+		return nil
+	}
+	if s.sharedLimiter != nil {
+		return s.sharedLimiter
+	}
+	return rate.NewLimiter(rate.Limit(s.rateLimit), s.rateLimit)
+}
+
+// throttle limits both directions of a tunnel with a single limiter
+func (s *Server) throttle(dst, src net.Conn) (net.Conn, net.Conn) {
+	lim := s.limiter()
+	if lim == nil {
+		return dst, src
+	}
+	return &limitedConn{dst, limitedReader{dst, lim, context.Background()}},
+		&limitedConn{src, limitedReader{src, lim, context.Background()}}
+}
+
+// limitReader limits reading r for an http body, until ctx is done
+func (s *Server) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	lim := s.limiter()
+	if lim == nil {
+		return r
+	}
+	return &limitedReader{r, lim, ctx}
+}
+
+// limitedReader waits for tokens of lim after each read
+type limitedReader struct {
+	r   io.Reader
+	lim *rate.Limiter
+	ctx context.Context
+}
+
+func (l *limitedReader) Read(data []byte) (int, error) {
+	// WaitN fails for more than burst tokens
+	if len(data) > l.lim.Burst() {
+		data = data[:l.lim.Burst()]
+	}
+
+	n, err := l.r.Read(data)
+	if n > 0 {
+		if werr := l.lim.WaitN(l.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+type limitedConn struct {
+	net.Conn
+	r limitedReader
+}
+
+func (c *limitedConn) Read(data []byte) (int, error) {
+	return c.r.Read(data)
+}
+
+func (c *limitedConn) unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// responseState tells whether a response was started or its conn
+// hijacked, after either a panic can not be answered anymore
+type responseState struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *responseState) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseState) Write(data []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(data)
+}
+
+// ReadFrom keeps the io.ReaderFrom of the wrapped writer for io.Copy
+func (w *responseState) ReadFrom(r io.Reader) (int64, error) {
+	w.started = true
+	return io.Copy(w.ResponseWriter, r)
+}
+
+// Flush implements http.Flusher
+func (w *responseState) Flush() {
+	w.started = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker
+func (w *responseState) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.started = true
+	return h.Hijack()
+}
+
+// recoverHTTP logs a panic of handling r and replies 500 if nothing was
+// written or hijacked yet, so the server survives bugs in handlers or pac
+// evaluation. http.ErrAbortHandler is passed on as net/http aborts the
+// response quietly.
+func (s *Server) recoverHTTP(w *responseState, r *http.Request) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if p == http.ErrAbortHandler {
+		panic(p)
+	}
+
+	s.logger.Printf("Error: [%s] %s %s panic: %v\n%s", remoteOf(r), r.Method, r.RequestURI, p, debug.Stack())
+	if !w.started {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// recoverConn logs a panic of serving a raw conn and closes it, unlike
+// http handlers nothing would recover it and the process would exit
+func (s *Server) recoverConn(conn net.Conn, what string) {
+	p := recover()
+	if p == nil {
+		return
+	}
+
+	s.logger.Printf("Error: [%s] %s panic: %v\n%s", conn.RemoteAddr(), what, p, debug.Stack())
+	conn.Close()
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/darren/gpac"
+)
+
+// logRecorder is a Logger keeping what was logged
+type logRecorder struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *logRecorder) Printf(format string, v ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func (l *logRecorder) Println(v ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintln(v...))
+	l.Unlock()
+}
+
+func (l *logRecorder) contains(s string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRecoverHandlerPanic(t *testing.T) {
+	logs := new(logRecorder)
+	finder := finderFunc(func(string) ([]*gpac.Proxy, error) {
+		panic("boom")
+	})
+	_, ts := newTestServer(t, Options{Finder: finder, Logger: logs})
+	client := proxyClient(t, ts)
+
+	// the server keeps serving after a panic
+	for i := 0; i < 2; i++ {
+		if code, _ := get(t, client, "http://example.com/"); code != http.StatusInternalServerError {
+			t.Errorf("GET #%d = %d, want 500", i, code)
+		}
+	}
+	if !logs.contains("panic: boom") {
+		t.Errorf("panic not logged, got %q", logs.lines)
+	}
+}
+
+// hijackRecorder is a ResponseWriter which can be hijacked,
+// writes after that are counted instead of failing
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+	late     int
+}
+
+func (w *hijackRecorder) WriteHeader(code int) {
+	if w.hijacked {
+		w.late++
+	}
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func (w *hijackRecorder) Write(data []byte) (int, error) {
+	if w.hijacked {
+		w.late++
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	client, server := net.Pipe()
+	client.Close()
+	return server, nil, nil
+}
+
+func TestRecoverAfterHijack(t *testing.T) {
+	logs := new(logRecorder)
+	s := newTestProxy(t, Options{Finder: staticFinder("DIRECT"), Logger: logs})
+
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	func() {
+		rw := &responseState{ResponseWriter: w}
+		defer s.recoverHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+		conn, _, err := rw.Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		panic("boom")
+	}()
+
+	if w.late != 0 {
+		t.Errorf("%d writes on the hijacked writer, want none", w.late)
+	}
+	if !logs.contains("panic: boom") {
+		t.Errorf("panic not logged, got %q", logs.lines)
+	}
+}
+
+func TestRecoverBeforeWrite(t *testing.T) {
+	s := newTestProxy(t, Options{Finder: staticFinder("DIRECT")})
+
+	for _, started := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		rw := &responseState{ResponseWriter: rec}
+		func() {
+			defer s.recoverHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if started {
+				rw.WriteHeader(http.StatusTeapot)
+				rw.Write([]byte("partial"))
+			}
+			panic("boom")
+		}()
+
+		body := rec.Body.String()
+		if started && (rec.Code != http.StatusTeapot || body != "partial") {
+			t.Errorf("panic after write replied %d %q, want the written response kept", rec.Code, body)
+		}
+		if !started && rec.Code != http.StatusInternalServerError {
+			t.Errorf("panic before write replied %d, want 500", rec.Code)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// maxRequestID is the longest request id taken over from a client
+const maxRequestID = 128
+
+type requestIDKey struct{}
+
+// newRequestID returns a random id, unique enough to tell
+// requests apart in the logs
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID returns r with its request id in the context. With
+// requestIDHeader set an id sent by the client is kept, otherwise the
+// header is set to a new one, and it is returned to the client too.
+func (s *Server) withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	var id string
+	if s.requestIDHeader != "" {
+		id = r.Header.Get(s.requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(s.requestIDHeader, id)
+		}
+		w.Header().Set(s.requestIDHeader, id)
+	} else {
+		id = newRequestID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// validRequestID tests whether id is safe to log and send on
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the request id of ctx, empty if it has none
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// remoteOf is the client of r as the access log prints it
+func remoteOf(r *http.Request) string {
+	rec := accessRecord{Remote: r.RemoteAddr, Client: clientName(r), ID: requestID(r.Context())}
+	return rec.remote()
+}
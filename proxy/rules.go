@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// header rule actions
+const (
+	headerDelete = "delete"
+	headerSet    = "set"
+	headerAppend = "append"
+)
+
+type headerRule struct {
+	action string
+	name   string
+	value  string
+}
+
+// HeaderRules rewrite headers of responses relayed to clients,
+// they are applied in order
+type HeaderRules []headerRule
+
+// String implements flag.Value
+func (h *HeaderRules) String() string {
+	if h == nil {
+		return ""
+	}
+	var items []string
+	for _, r := range *h {
+		item := r.action + ":" + r.name
+		if r.action != headerDelete {
+			item += "=" + r.value
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ",")
+}
+
+// Set implements flag.Value, it parses delete:Name, set:Name=value
+// or append:Name=value
+func (h *HeaderRules) Set(v string) error {
+	i := strings.IndexByte(v, ':')
+	if i <= 0 {
+		return fmt.Errorf("invalid header rule %q, want action:Name[=value]", v)
+	}
+
+	r := headerRule{action: strings.ToLower(v[:i]), name: v[i+1:]}
+	if j := strings.IndexByte(r.name, '='); j >= 0 {
+		r.name, r.value = r.name[:j], r.name[j+1:]
+	} else if r.action != headerDelete {
+		return fmt.Errorf("invalid header rule %q, %s needs Name=value", v, r.action)
+	}
+
+	r.name = http.CanonicalHeaderKey(strings.TrimSpace(r.name))
+	if r.name == "" {
+		return fmt.Errorf("invalid header rule %q, no header name", v)
+	}
+
+	switch r.action {
+	case headerDelete, headerSet, headerAppend:
+	default:
+		return fmt.Errorf("invalid header rule %q, action is delete, set or append", v)
+	}
+
+	*h = append(*h, r)
+	return nil
+}
+
+// apply rewrites h following the rules
+func (h HeaderRules) apply(hdr http.Header) {
+	for _, r := range h {
+		switch r.action {
+		case headerDelete:
+			hdr.Del(r.name)
+		case headerSet:
+			hdr.Set(r.name, r.value)
+		case headerAppend:
+			hdr.Add(r.name, r.value)
+		}
+	}
+}
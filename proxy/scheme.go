@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// PortSchemes maps CONNECT ports to the scheme of the url passed to pac,
+// the * entry is used for ports not mapped, https when there is none
+type PortSchemes map[string]string
+
+// String implements flag.Value
+func (p PortSchemes) String() string {
+	items := make([]string, 0, len(p))
+	for port, scheme := range p {
+		items = append(items, port+"="+scheme)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// Set implements flag.Value, it parses port=scheme like 21=ftp or *=tcp
+func (p PortSchemes) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid connect scheme %q, want port=scheme", v)
+	}
+
+	port, scheme := strings.TrimSpace(v[:i]), strings.ToLower(strings.TrimSpace(v[i+1:]))
+	if port != "*" && !isPort(port) || !validScheme(scheme) {
+		return fmt.Errorf("invalid connect scheme %q, want port=scheme", v)
+	}
+
+	p[port] = scheme
+	return nil
+}
+
+// validScheme tests s against the scheme syntax of RFC 3986
+func validScheme(s string) bool {
+	if s == "" || s[0] < 'a' || s[0] > 'z' {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '+', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// scheme returns the scheme for port
+func (p PortSchemes) scheme(port string) string {
+	if scheme, ok := p[port]; ok {
+		return scheme
+	}
+	if scheme, ok := p["*"]; ok {
+		return scheme
+	}
+	return "https"
+}
+
+// defaultPorts are left out of urls of their scheme
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+}
+
+// connectURL returns the url passed to pac for a tunnel to hostport, its
+// scheme follows connectSchemes. IPv6 literals are kept in brackets
+// like https://[2001:db8::1]:8443/
+func (s *Server) connectURL(hostport string) string {
+	host, port, _ := net.SplitHostPort(hostport)
+	scheme := s.connectSchemes.scheme(port)
+	if defaultPorts[scheme] == port {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return fmt.Sprintf("%s://%s/", scheme, host)
+	}
+	return fmt.Sprintf("%s://%s/", scheme, net.JoinHostPort(host, port))
+}
+
+// Forms of the url of http requests passed to pac
+const (
+	// PacURLFull passes the whole url including path and query
+	PacURLFull = "full"
+	// PacURLHost passes scheme://host[:port]/ like for CONNECT
+	PacURLHost = "host"
+)
+
+// pacURL returns the url passed to pac for a http request to u
+func (s *Server) pacURL(u *url.URL) string {
+	if s.pacURLForm == PacURLFull {
+		return u.String()
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String()
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/darren/gpac"
+)
+
+func TestConnectURL(t *testing.T) {
+	s := newTestProxy(t, Options{Finder: staticFinder("DIRECT"), ConnectSchemes: PortSchemes{"21": "ftp"}})
+
+	tests := []struct {
+		hostport string
+		url      string
+	}{
+		{"example.com:443", "https://example.com/"},
+		{"example.com:8443", "https://example.com:8443/"},
+		{"192.0.2.1:443", "https://192.0.2.1/"},
+		{"[2001:db8::1]:443", "https://[2001:db8::1]/"},
+		{"[2001:db8::1]:8443", "https://[2001:db8::1]:8443/"},
+		{"[::1]:21", "ftp://[::1]/"},
+		{"[::1]:2121", "https://[::1]:2121/"},
+	}
+
+	for _, tt := range tests {
+		got := s.connectURL(tt.hostport)
+		if got != tt.url {
+			t.Errorf("connectURL(%s) = %s, want %s", tt.hostport, got, tt.url)
+			continue
+		}
+		host, _, _ := net.SplitHostPort(tt.hostport)
+		if u, err := url.Parse(got); err != nil || u.Hostname() != host {
+			t.Errorf("connectURL(%s) = %s does not parse back to host %s: %v", tt.hostport, got, host, err)
+		}
+	}
+}
+
+func TestConnectIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6 loopback: %v", err)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer l.Close()
+
+	var mu sync.Mutex
+	var asked string
+	finder := finderFunc(func(urlstr string) ([]*gpac.Proxy, error) {
+		mu.Lock()
+		asked = urlstr
+		mu.Unlock()
+		return gpac.ParseProxy("DIRECT"), nil
+	})
+	_, ts := newTestServer(t, Options{Finder: finder})
+
+	resp, body, conn := connect(t, ts, l.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s = %d %q, want 200", l.Addr(), resp.StatusCode, body)
+	}
+	// talk plain http through the tunnel
+	req, _ := http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+"/", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	tunneled, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneled.Body.Close()
+	if tunneled.StatusCode != http.StatusNoContent {
+		t.Errorf("GET through the tunnel = %d, want 204", tunneled.StatusCode)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	if want := "https://[::1]:" + port + "/"; asked != want {
+		t.Errorf("pac asked for %s, want %s", asked, want)
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// isPacRequest tests whether r asks for the pac file served at pacPath,
+// like for the health check only origin-form requests qualify
+func (s *Server) isPacRequest(r *http.Request) bool {
+	return s.pacPath != "" &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		r.URL.Host == "" &&
+		r.URL.Path == s.pacPath
+}
+
+// handleServePac serves the source of the first loaded pac file so
+// clients can be configured with pacroxy as their wpad server
+func (s *Server) handleServePac(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	pacs := s.pacs
+	s.Unlock()
+
+	if len(pacs) == 0 || pacs[0] == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.WriteString(w, pacs[0].Source())
+}
@@ -0,0 +1,1453 @@
+// Package proxy implements an http proxy which forwards requests to
+// the proxies found in a pac file
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darren/gpac"
+	"golang.org/x/time/rate"
+)
+
+// Options configures the proxy server
+type Options struct {
+	Addr       string   // listening addresses separated by comma
+	PacSource  string   // comma separated pac file paths or http(s) urls, consulted in order, - reads stdin
+	PacSources []Source // pac sources used instead of PacSource and WPAD when not empty
+	// Finder finds proxies instead of pac files when set, PacSource,
+	// PacSources and WPAD are then ignored, eg: to fake pac in tests
+	Finder   PacFinder
+	PacMerge string // how results of multiple pacs are merged: first (default) or concat
+	// PacURL is the form of http request urls passed to pac: full (default)
+	// or host, which passes scheme://host/ as CONNECT always does
+	PacURL          string
+	RefreshInterval time.Duration // interval to reload the pac, 0 disables refresh
+	FetchTimeout    time.Duration // timeout for fetching remote pac
+	UserAgent       string        // User-Agent of remote pac and wpad fetches, empty sends the net/http default
+	PacTimeout      time.Duration // timeout for evaluating FindProxyForURL, 0 means no timeout
+	DialTimeout     time.Duration // timeout for dialing each proxy, 0 means no timeout
+	Retries         int           // times to retry a failed dial or round trip on the same proxy
+	RetryBackoff    time.Duration // initial backoff between retries, doubled on each retry
+	TunnelIdle      time.Duration // close tunnels idle in both directions for this long, 0 disables
+	SlowThreshold   time.Duration // warn about requests and tunnel setups taking longer, 0 disables
+
+	ReadTimeout           time.Duration // timeout for reading a whole http response from upstream, 0 means no timeout
+	ResponseHeaderTimeout time.Duration // timeout for awaiting http response headers from upstream, 0 means no timeout
+	ReadHeaderTimeout     time.Duration // timeout for reading request headers from clients, 0 means no timeout
+	IdleConnTimeout       time.Duration // time idle upstream conns are kept, 0 keeps them until closed by the peer
+	MaxIdleConns          int           // idle conns kept per upstream proxy and in total for DIRECT, 0 uses the net/http defaults
+	KeepAlive             time.Duration // tcp keep-alive period of client conns, 0 uses the default, negative disables
+
+	// ReusePort sets SO_REUSEPORT on the proxy listeners, so a restarted
+	// proxy binds while the old one still listens. SO_REUSEADDR is always
+	// set by the go runtime on unix. Linux only.
+	ReusePort bool
+	// FastOpen is the TCP Fast Open queue length of the proxy listeners,
+	// 0 disables. Linux only.
+	FastOpen int
+
+	MaxHeaderBytes int   // maximum size of client request headers, 0 uses http.DefaultMaxHeaderBytes
+	MaxBodyBytes   int64 // maximum size of client request bodies, 0 means unlimited
+	MaxClients     int   // maximum requests and tunnels handled at once, more get 503, 0 means unlimited
+
+	MetricsAddr string // listening address of prometheus metrics, empty to disable
+	// Listeners are bound listeners by address used instead of binding
+	// Addr, SocksAddr or MetricsAddr, eg: taken over from another process
+	// with its ListenerFiles, those not configured anymore are closed
+	Listeners map[string]net.Listener
+	// MetricsRequired makes Start fail when MetricsAddr can not be bound,
+	// otherwise the proxy runs without metrics and logs the error
+	MetricsRequired bool
+	LogFormat       string // access log format: text (default) or json
+	HealthPath      string // path of the health check endpoint, empty to disable
+	PacPath         string // path the first loaded pac file is served at to clients, empty to disable
+	SocksAddr       string // listening address of socks5 proxy, empty to disable
+
+	TLSCert string // certificate file to serve the proxy over tls, requires TLSKey
+	TLSKey  string // private key file of TLSCert
+	// DisableHTTP2 serves tls clients http/1.1 only, by default http/2 is
+	// negotiated, CONNECT is then streamed instead of hijacking the conn
+	DisableHTTP2 bool
+	// ClientCA is a pem file of CAs client certificates are verified
+	// against, clients without a valid one are refused, requires TLSCert
+	ClientCA string
+
+	Credentials Credentials // inbound proxy credentials, empty allows everyone
+	Allow       string      // comma separated CIDRs clients may connect from, empty allows all, unix socket clients are not checked
+	ForceAllow  string      // comma separated CIDRs of clients whose X-Pacroxy-Force header is honored, empty disables
+
+	// RequestIDHeader is the header the request id is taken from,
+	// forwarded in and returned to the client in, empty keeps it to the logs
+	RequestIDHeader string
+	ForceClients    []string     // client certificate names whose X-Pacroxy-Force header is honored, requires ClientCA
+	UpstreamAuth    UpstreamAuth // credentials sent to upstream http and socks5 proxies
+	Overrides       Overrides    // proxies for matching hosts used instead of pac
+	// NoProxy is a NO_PROXY like list of hosts, IPs, CIDRs and domains
+	// always connected directly without consulting pac or Overrides
+	NoProxy string
+	// ConnectSchemes maps CONNECT ports to the scheme of the url passed
+	// to pac, by default every port is taken as https
+	ConnectSchemes PortSchemes
+	// ConnectPorts are the comma separated ports and lo-hi ranges CONNECT
+	// and socks5 may tunnel to, others get 403, empty or all allows all
+	ConnectPorts string
+	NextHop      string // http proxy host:port all connections are finally made through, empty to disable
+
+	UpstreamInsecure bool         // skip verifying certificates of HTTPS proxies
+	UpstreamNTLM     UpstreamNTLM // NTLM credentials for upstream proxies, used instead of UpstreamAuth
+
+	CacheSize      int           // number of hosts to cache pac results for, 0 disables the cache
+	CacheTTL       time.Duration // time to keep cached pac results, 0 keeps them until evicted
+	DNSCacheTTL    time.Duration // time to cache host lookups of direct connections, 0 disables
+	IPVersion      string        // ip version of direct connections: auto (default), 4 or 6
+	DirectFallback bool          // connect directly when all pac proxies failed
+	VerboseErrors  bool          // include the last upstream error and proxies tried in error responses
+
+	// BreakerThreshold is the number of consecutive failures after which
+	// a proxy is skipped for BreakerCooldown, 0 disables the breakers
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// SmartSelect tries the proxies returned by pac ordered by their
+	// recent latency and success rate instead of the pac order
+	SmartSelect bool
+
+	Via          string   // identity appended to the Via header of forwarded requests, empty to disable
+	StripHeaders []string // request headers removed before forwarding
+	HopHeaders   []string // headers treated as hop-by-hop in addition to the standard ones
+	// ResponseHeaders rewrite headers of responses before they are relayed
+	ResponseHeaders HeaderRules
+	NoXFF           bool     // do not add X-Forwarded-For and X-Forwarded-Proto to forwarded requests
+	BlockMethods    []string // request methods rejected with 405 in any case, eg: TRACE
+
+	// MaxConnsPerProxy limits concurrent connections to each upstream proxy,
+	// a proxy at its limit is skipped after waiting ProxyLimitWait for a free slot
+	MaxConnsPerProxy int
+	ProxyLimitWait   time.Duration
+
+	RateLimit       int  // bytes per second each connection may transfer, 0 means unlimited
+	RateLimitShared bool // apply RateLimit to all connections together instead of each
+
+	// Strict refuses pac files which fail to load or whose FindProxyForURL
+	// does not evaluate, both at startup and on reload
+	Strict bool
+
+	// WPAD discovers the pac url from the search domains at startup and
+	// on reload, PacSource is used when discovery fails
+	WPAD bool
+
+	// OnReload is called after Reload swapped in a changed pac file, old is
+	// nil when the pac sources changed with wpad, OnReloadError is called when reloading a pac file failed.
+	// Both are called from the reloading goroutine after the swap
+	OnReload      func(old, new *gpac.Parser)
+	OnReloadError func(source string, err error)
+
+	// OnReady is called by Start once all listeners are bound and
+	// served, eg: to let a process handing over its listeners drain
+	OnReady func()
+
+	BuildInfo BuildInfo // reported on /version of the metrics listener
+
+	Logger    Logger    // defaults to log.New(os.Stderr, "", log.LstdFlags)
+	AccessLog io.Writer // destination of json access logs, defaults to os.Stderr, must be safe for concurrent writes
+
+	// Dialer makes all outgoing tcp connections, to DIRECT targets, to
+	// upstream proxies and to remote pac files, defaults to a net.Dialer. With DNSCacheTTL it is
+	// given resolved addresses, it is called for each IPVersion network.
+	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Logger is used by Server for all its logs, *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// Server the proxy server
+type Server struct {
+	http.Server
+	sync.Mutex
+
+	sources          []Source       // pac sources, guarded by Mutex, loaded under reloadMu
+	pacs             []*gpac.Parser // one parser per pac file, guarded by Mutex, replaced never modified
+	pacMerge         string
+	pacURLForm       string
+	refreshDuration  time.Duration
+	fetchTimeout     time.Duration
+	fetcher          *fetcher
+	pacTimeout       time.Duration
+	dialTimeout      time.Duration
+	retries          int
+	retryBackoff     time.Duration
+	readTimeout      time.Duration
+	headerTimeout    time.Duration
+	keepAlive        time.Duration
+	reusePort        bool
+	fastOpen         int
+	idleConnTimeout  time.Duration
+	maxIdleConns     int
+	maxBodyBytes     int64
+	tunnelIdle       time.Duration
+	metricsAddr      string
+	metricsRequired  bool
+	logFormat        string
+	slowThreshold    time.Duration
+	auth             Credentials
+	allow            allowList
+	forceAllow       allowList
+	requestIDHeader  string
+	forceClients     map[string]bool
+	upstreamAuth     UpstreamAuth
+	upstreamInsecure bool
+	upstreamNTLM     UpstreamNTLM
+	overrides        Overrides
+	noProxy          *noProxy  // nil if empty
+	finder           PacFinder // nil unless set in Options
+	connectSchemes   PortSchemes
+	connectPorts     portList    // nil allows all
+	nextHop          *gpac.Proxy // nil unless NextHop
+	healthPath       string
+	pacPath          string
+	directFallback   bool
+	verboseErrors    bool
+	via              string
+	stripHeaders     []string
+	hopHeaders       []string
+	responseHeaders  HeaderRules
+	noXFF            bool
+	blockMethods     map[string]bool
+	strict           bool
+	wpad             bool
+	fallbackSources  []string // pac sources used when wpad discovery fails
+	socksAddr        string
+	tlsCert          string
+	tlsKey           string
+	rateLimit        int
+	maxConnsPerProxy int
+	limitWait        time.Duration
+	conns            map[string]chan struct{} // connection slots by proxy, guarded by Mutex
+	sharedLimiter    *rate.Limiter            // nil unless RateLimitShared
+	onReload         func(old, new *gpac.Parser)
+	onReloadError    func(source string, err error)
+	onReady          func()
+
+	loadedAt  time.Time     // last time all pac files loaded successfully, zero if never
+	reloadErr error         // error of the last load, nil if it succeeded
+	reloadMu  sync.Mutex    // serializes Reload
+	quit      chan struct{} // closed on Shutdown to stop the watcher
+	quitOnce  sync.Once
+
+	socks      net.Listener            // nil if not started
+	inherited  map[string]net.Listener // from Options.Listeners not bound yet, guarded by Mutex
+	listeners  map[string]net.Listener // bound listeners by address, guarded by Mutex
+	bound      []net.Addr              // addresses of the proxy listeners, guarded by Mutex
+	admin      net.Listener            // metrics listener, nil if not started
+	logger     Logger
+	accessLog  io.Writer
+	cache      *proxyCache // nil if disabled
+	dns        *dnsCache   // nil if disabled
+	breakers   *breakers   // nil if disabled
+	latencies  *latencies  // nil unless SmartSelect
+	drains     *drains
+	ipNetwork  string   // network of direct connections following IPVersion
+	dial       dialFunc // makes all outgoing connections
+	buildInfo  BuildInfo
+	transports map[string]roundTripper // transports by proxy, guarded by Mutex
+	metrics    *metrics
+	stats      *stats         // allocated separately to keep its counters aligned
+	tunnels    sync.WaitGroup // active CONNECT tunnels
+	clients    chan struct{}  // slots of requests being handled, nil if unlimited
+}
+
+// ServeHTTP handles proxy requests like the listeners of Start do,
+// so the proxy can be served by another http.Server or httptest
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = s.withRequestID(w, r)
+	rw := &responseState{ResponseWriter: w}
+	defer s.recoverHTTP(rw, r)
+	s.handle(rw, r)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.isHealthCheck(r) {
+		s.handleHealth(w, r)
+		return
+	}
+
+	if !s.acquireClient() {
+		s.logger.Printf("[%s] %s %s rejected: too many clients", remoteOf(r), r.Method, r.RequestURI)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.releaseClient()
+
+	s.metrics.request(r.Method)
+
+	if s.blockMethods[strings.ToUpper(r.Method)] {
+		s.logger.Printf("[%s] %s %s rejected: method blocked", remoteOf(r), r.Method, r.RequestURI)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !fromUnix(local) && !s.allow.allows(r.RemoteAddr) {
+		s.logger.Printf("[%s] %s %s rejected: client not allowed", remoteOf(r), r.Method, r.RequestURI)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// browsers fetch pac files without proxy credentials
+	if s.isPacRequest(r) {
+		s.handleServePac(w, r)
+		return
+	}
+
+	if !s.auth.check(r) {
+		requireAuth(w)
+		return
+	}
+
+	r, err := s.forceProxies(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// http/2 has no absolute-form, requests to forward carry the target
+	// in :authority and https ones are tunneled with CONNECT
+	if r.ProtoMajor == 2 && r.Method != http.MethodConnect && r.URL.Host == "" {
+		r.URL.Scheme, r.URL.Host = "http", r.Host
+	}
+
+	// requests which can not be forwarded fail before any proxy is tried,
+	// so they never count against a proxy
+	if err := checkTarget(r); err != nil {
+		s.logger.Printf("[%s] %s %s rejected: %v", remoteOf(r), r.Method, r.RequestURI, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		s.handleConnect(w, r)
+	} else if isUpgrade(r.Header) && r.ProtoMajor == 1 {
+		// http/2 has no upgrades, the conn can not be hijacked
+		s.handleUpgrade(w, r)
+	} else {
+		s.handleHTTP(w, r)
+	}
+}
+
+// checkTarget tests whether r names a target to forward to:
+// CONNECT needs host:port, other requests an absolute http(s) url
+func checkTarget(r *http.Request) error {
+	if r.Method == http.MethodConnect {
+		host, port, err := net.SplitHostPort(r.Host)
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("CONNECT target %q is not host:port", r.Host)
+		}
+		return nil
+	}
+
+	if r.URL.Host == "" {
+		return errors.New("no host in request url")
+	}
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", r.URL.Scheme)
+	}
+	return nil
+}
+
+// fallbackProxy is tried after all pac proxies failed when direct fallback is enabled
+var fallbackProxy = &gpac.Proxy{Type: "DIRECT"}
+
+// clientConn answers CONNECT with 200 and returns the conn to tunnel.
+// http/1 conns are hijacked, http/2 streams the request body and response.
+// Failures before the conn is taken over are reported to the client.
+func (s *Server) clientConn(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.ProtoMajor == 2 {
+		conn, ok := newStreamConn(w, r)
+		if !ok {
+			err := fmt.Errorf("streaming not supported for %s CONNECT", r.Proto)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, err
+		}
+		w.WriteHeader(http.StatusOK)
+		conn.flusher.Flush()
+		return conn, nil
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err := fmt.Errorf("hijacking not supported for %s CONNECT", r.Proto)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	src, buf, err := hijacker.Hijack()
+	if err != nil {
+		err = fmt.Errorf("hijack %s CONNECT: %v", r.Proto, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, err
+	}
+
+	// written on the raw conn, WriteHeader before Hijack may announce a
+	// chunked body which clients would take as part of the tunnel
+	if _, err := io.WriteString(src, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		src.Close()
+		return nil, err
+	}
+	return combine(buf, src), nil
+}
+
+// withFallback appends fallbackProxy to proxies if direct fallback is enabled
+// and proxies does not contain DIRECT already
+func (s *Server) withFallback(proxies []*gpac.Proxy) []*gpac.Proxy {
+	if !s.directFallback {
+		return proxies
+	}
+
+	for _, proxy := range proxies {
+		if proxy.IsDirect() {
+			return proxies
+		}
+	}
+
+	// proxies may be shared with the cache, never append in place
+	return append(proxies[:len(proxies):len(proxies)], fallbackProxy)
+}
+
+// dialTarget finds proxies for url and connects to hostport
+// through the first proxy that succeeds
+func (s *Server) dialTarget(ctx context.Context, rec *accessRecord, url, hostport string) (net.Conn, *gpac.Proxy, error) {
+	proxies, err := s.route(ctx, url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dst net.Conn
+	var proxy *gpac.Proxy
+
+	for _, proxy = range s.withFallback(s.latencies.sort(proxies)) {
+		if proxy == fallbackProxy {
+			s.logger.Printf("[%s] All proxies failed for %s, falling back to DIRECT", rec.remote(), url)
+		}
+		began := time.Now()
+		if berr := s.skip(proxy); berr != nil {
+			err = berr
+			rec.attempt(proxy, err, true, began)
+			s.logger.Printf("[%s] Dial skipped: %v", rec.remote(), err)
+			continue
+		}
+		release, aerr := s.acquire(ctx, proxy)
+		if aerr != nil {
+			err = aerr
+			rec.attempt(proxy, err, true, began)
+			s.logger.Printf("[%s] Dial skipped: %v", rec.remote(), err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		dialer := s.dialer(proxy)
+		err = s.retry(ctx, s.retries, func() error {
+			dctx, cancel := s.dialContext(ctx)
+			defer cancel()
+
+			var derr error
+			dst, derr = dialer(dctx, "tcp", hostport)
+			s.metrics.proxyResult(proxy.String(), derr)
+			if derr != nil {
+				s.logger.Printf("[%s] Dial failed: %v", rec.remote(), derr)
+			}
+			return derr
+		})
+		rec.attempt(proxy, err, false, began)
+		if ctx.Err() == nil {
+			s.breakers.record(proxy, err)
+			s.latencies.record(proxy, err, time.Since(began))
+		}
+		if err == nil {
+			dst = &releaseConn{dst, release}
+			break
+		}
+		release()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, nil, &attemptError{rec.tried(), err}
+	}
+
+	if proxy == nil {
+		return nil, nil, ErrNoProxyAvailable
+	}
+
+	return dst, proxy, nil
+}
+
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	url := s.connectURL(r.Host)
+	rec := &accessRecord{ID: requestID(r.Context()), Remote: r.RemoteAddr, Client: clientName(r), Method: r.Method, URL: url, Authority: r.Host}
+
+	if !s.connectPorts.allows(r.Host) {
+		rec.Status = http.StatusForbidden
+		rec.Error = "port not allowed"
+		s.logRequest(rec, start)
+		http.Error(w, "Forbidden: port not allowed", rec.Status)
+		return
+	}
+
+	dst, proxy, err := s.dialTarget(r.Context(), rec, url, r.Host)
+	if err != nil {
+		rec.Error = err.Error()
+		s.logRequest(rec, start)
+		s.proxyError(w, err, errorStatus(err))
+		return
+	}
+	rec.Proxy = proxy.String()
+
+	src, err := s.clientConn(w, r)
+	if err != nil {
+		dst.Close()
+		rec.Error = err.Error()
+		s.logRequest(rec, start)
+		return
+	}
+
+	s.tunnels.Add(1)
+	defer s.tunnels.Done()
+	defer s.stats.begin(&s.stats.ActiveTunnels)()
+
+	rec.setup = time.Since(start)
+	dst, src = s.throttle(dst, src)
+	rec.Sent, rec.Received = tunnel(dst, src, s.tunnelIdle)
+	s.metrics.tunnel(rec.Sent, rec.Received)
+	s.logRequest(rec, start)
+}
+
+// dialContext returns the context for dialing a single proxy
+func (s *Server) dialContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.dialTimeout > 0 {
+		return context.WithTimeout(parent, s.dialTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// handleHTTP forwards req to the first proxy that returns a response.
+// Failover only happens until response headers are received, once the
+// header is written to the client the proxy is selected and errors while
+// copying the body can not be retried since the client already got bytes.
+func (s *Server) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	defer s.stats.begin(&s.stats.ActiveRequests)()
+	rec := &accessRecord{ID: requestID(req.Context()), Remote: req.RemoteAddr, Client: clientName(req), Method: req.Method, URL: req.URL.String()}
+
+	proxies, err := s.route(req.Context(), s.pacURL(req.URL))
+	if err != nil {
+		rec.Error = err.Error()
+		s.logRequest(rec, start)
+		s.proxyError(w, err, errorStatus(err))
+		return
+	}
+
+	body, ok := s.limitBody(w, req)
+	if !ok {
+		rec.Status = http.StatusRequestEntityTooLarge
+		rec.Error = errBodyTooLarge.Error()
+		s.logRequest(rec, start)
+		http.Error(w, rec.Error, rec.Status)
+		return
+	}
+
+	// bodies the client fails to send must not count against proxies
+	large, err := bufferBody(req)
+	if err != nil {
+		rec.Status = http.StatusBadRequest
+		if body.exceeded() {
+			rec.Status = http.StatusRequestEntityTooLarge
+		}
+		rec.Error = fmt.Sprintf("read request body: %v", err)
+		s.logRequest(rec, start)
+		http.Error(w, rec.Error, rec.Status)
+		return
+	}
+
+	s.prune(req.Header)
+	s.rewriteHeaders(req)
+
+	var resp *http.Response
+	var cancel context.CancelFunc
+	var release func()
+	var proxy *gpac.Proxy
+
+	// a large body is only sent once, it is neither retried nor
+	// sent to the next proxy once it was read
+	retries := s.retries
+	if large != nil {
+		retries = 0
+	}
+
+	for _, proxy = range s.withFallback(s.latencies.sort(proxies)) {
+		if proxy == fallbackProxy {
+			s.logger.Printf("[%s] All proxies failed for %s, falling back to DIRECT", rec.remote(), req.URL)
+		}
+		began := time.Now()
+		if err = s.skip(proxy); err != nil {
+			rec.attempt(proxy, err, true, began)
+			s.logger.Printf("[%s] %s %v skipped: %v", rec.remote(), req.Method, req.URL, err)
+			continue
+		}
+		release, err = s.acquire(req.Context(), proxy)
+		if err != nil {
+			rec.attempt(proxy, err, true, began)
+			s.logger.Printf("[%s] %s %v skipped: %v", rec.remote(), req.Method, req.URL, err)
+			if req.Context().Err() != nil {
+				break
+			}
+			continue
+		}
+
+		s.upstreamAuth.apply(req.Header, s.hop(proxy))
+		err = s.retry(req.Context(), retries, func() error {
+			// each attempt sends the buffered body from its start
+			if req.GetBody != nil {
+				req.Body, _ = req.GetBody()
+			}
+			var rerr error
+			resp, cancel, rerr = s.roundTrip(req, proxy)
+			s.metrics.proxyResult(proxy.String(), rerr)
+			return rerr
+		})
+		rec.attempt(proxy, err, false, began)
+		// failures of clients going away, sending too much or
+		// failing to send their body say nothing about the proxy
+		local := err != nil && (body.exceeded() || large.failed())
+		if req.Context().Err() == nil && !local {
+			s.breakers.record(proxy, err)
+			s.latencies.record(proxy, err, time.Since(began))
+		}
+		if local {
+			release()
+			break
+		}
+		if err == nil {
+			break
+		}
+		release()
+		if req.Context().Err() != nil {
+			break
+		}
+		if large.sent() {
+			s.logger.Printf("[%s] %s %v request body already sent to [%v], not trying other proxies",
+				rec.remote(), req.Method, req.URL, proxy)
+			break
+		}
+	}
+
+	if resp == nil && body.exceeded() {
+		rec.Status = http.StatusRequestEntityTooLarge
+		rec.Error = errBodyTooLarge.Error()
+		s.logRequest(rec, start)
+		http.Error(w, rec.Error, rec.Status)
+		return
+	}
+
+	if resp == nil {
+		if err == nil {
+			err = ErrNoProxyAvailable
+		} else {
+			err = &attemptError{rec.tried(), err}
+		}
+		rec.Status = errorStatus(err)
+		rec.Error = err.Error()
+		s.logRequest(rec, start)
+		s.proxyError(w, err, rec.Status)
+		return
+	}
+
+	defer release()
+	defer cancel()
+	defer resp.Body.Close()
+
+	rec.Proxy = proxy.String()
+	rec.Status = resp.StatusCode
+
+	// hop-by-hop headers are about the upstream conn, net/http frames
+	// the response to the client itself
+	s.prune(resp.Header)
+	s.responseHeaders.apply(resp.Header)
+	cloneHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	// abort the copy promptly when the client goes away, closing
+	// the body also releases the upstream connection
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-req.Context().Done():
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+
+	rec.Received, err = io.Copy(w, s.limitReader(req.Context(), resp.Body))
+	close(done)
+	if err != nil && req.Context().Err() != nil {
+		err = fmt.Errorf("client gone: %v", req.Context().Err())
+	}
+	if err != nil {
+		rec.BodyError = err.Error()
+		s.logger.Printf("[%s] %s %v [%v] copy body failed after %d bytes: %v",
+			rec.remote(), req.Method, req.URL, proxy, rec.Received, err)
+	}
+	s.logRequest(rec, start)
+}
+
+// retry calls fn until it succeeds, at most retries more times after the first
+// call, sleeping a jittered exponential backoff in between. It gives up
+// early when ctx is done so disconnected clients do not trigger retries.
+func (s *Server) retry(ctx context.Context, retries int, fn func() error) error {
+	backoff := s.retryBackoff
+
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= retries {
+			return err
+		}
+
+		// sleep a random duration in [backoff/2, backoff]
+		var d time.Duration
+		if backoff > 0 {
+			d = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+		backoff *= 2
+	}
+}
+
+// roundTrip sends req via proxy. Response headers must arrive within
+// responseHeaderTimeout and the whole response must be read within readTimeout.
+// On success the returned cancel func must be called after the body is consumed.
+func (s *Server) roundTrip(req *http.Request, proxy *gpac.Proxy) (*http.Response, context.CancelFunc, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.readTimeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), s.readTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+
+	var timer *time.Timer
+	if s.headerTimeout > 0 {
+		timer = time.AfterFunc(s.headerTimeout, cancel)
+	}
+
+	resp, err := s.transport(proxy).RoundTrip(req.WithContext(ctx))
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = fmt.Errorf("%v: timeout awaiting response headers", proxy)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return resp, cancel, nil
+}
+
+// FindProxy returns the proxies to try in order for urlstr, as the bypass
+// list, overrides, the cache and loaded pac files decide. Errors are
+// ErrNoProxyAvailable or ErrPacEvaluation.
+func (s *Server) FindProxy(urlstr string) ([]*gpac.Proxy, error) {
+	return s.findProxy(urlstr)
+}
+
+// findProxy finds proxies for urlstr, hosts bypassing pac go DIRECT and
+// overrides take precedence over pac. Results are cached by url host when
+// the cache is enabled since most pac logic keys on host
+func (s *Server) findProxy(urlstr string) ([]*gpac.Proxy, error) {
+	if s.noProxy.match(urlstr) {
+		return directProxies, nil
+	}
+
+	if proxies, ok := s.overrides.match(urlstr); ok {
+		return proxies, nil
+	}
+
+	var gen uint64
+
+	s.Lock()
+	pacs := s.pacs
+	if s.cache != nil {
+		gen = s.cache.generation()
+	}
+	s.Unlock()
+
+	if s.cache == nil {
+		return s.evalPacs(pacs, urlstr)
+	}
+
+	key := cacheKey(urlstr)
+	if proxies, ok := s.cache.get(key); ok {
+		return proxies, nil
+	}
+
+	proxies, err := s.evalPacs(pacs, urlstr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.put(key, proxies, gen)
+	return proxies, nil
+}
+
+// evalPacs finds the proxies for urlstr with the finder or else pacs,
+// errors other than finding no proxies are wrapped as ErrPacEvaluation
+func (s *Server) evalPacs(pacs []*gpac.Parser, urlstr string) ([]*gpac.Proxy, error) {
+	var proxies []*gpac.Proxy
+	var err error
+	if s.finder != nil {
+		proxies, err = s.finder.FindProxy(urlstr)
+		if err == nil && len(proxies) == 0 {
+			err = fmt.Errorf("%w for %s", ErrNoProxyAvailable, urlstr)
+		}
+	} else {
+		proxies, err = evalPacs(pacs, s.pacMerge, urlstr, s.pacTimeout)
+	}
+
+	if err != nil && !errors.Is(err, ErrNoProxyAvailable) {
+		err = &pacError{urlstr, err}
+	}
+	return proxies, err
+}
+
+// Reload loads all pac files and swaps in the ones whose content changed,
+// pac files failed to load keep their previous version.
+// Requests take the pac files once when they start, so requests in flight
+// finish with the proxies they found and running tunnels stay on their
+// route, only requests started after Reload see the new pac files.
+func (s *Server) Reload() error {
+	_, err := s.reload()
+	return err
+}
+
+// reload implements Reload, it also reports whether any pac was swapped in
+func (s *Server) reload() (bool, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.Lock()
+	sources := s.sources
+	pacs := append([]*gpac.Parser(nil), s.pacs...)
+	s.Unlock()
+
+	var errs []string
+	var changed bool
+	var failed []reloadError
+
+	// wpad may find another pac url, which is loaded afresh
+	if s.wpad {
+		names := wpadSources(s.logger, s.fetchTimeout, s.fetcher, s.fallbackSources)
+		if !sameSources(names, sourceNames(sources)) {
+			s.logger.Printf("Pac sources changed to %s", strings.Join(names, ","))
+			sources = newSources(names, s.fetcher)
+			pacs = make([]*gpac.Parser, len(sources))
+			changed = true
+		}
+	}
+
+	for i, source := range sources {
+		src := source.String()
+
+		// hung parsers are replaced by a fresh one of the same pac,
+		// whether or not the source changed
+		if pacs[i] != nil && isHung(pacs[i]) {
+			if pac, err := gpac.New(pacs[i].Source()); err == nil {
+				pacs[i] = pac
+				changed = true
+			}
+		}
+
+		// sources tell when they did not change, eg: local files whose
+		// mtime and size are the same or remote ones answering 304,
+		// content comparison below still decides for everything else
+		s.logger.Printf("Try reloading from %s", src)
+		pac, err := loadPac(source, s.fetchTimeout)
+		if err == ErrNotModified {
+			s.metrics.reload(nil)
+			s.logger.Printf("Pac file %s not changed", src)
+			continue
+		}
+		if err == nil && s.strict {
+			err = validatePac(pac, s.pacTimeout)
+		}
+		s.metrics.reload(err)
+		if err != nil {
+			forget(source)
+			s.logger.Printf("Refresh pac %s failed: %v", src, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", src, err))
+			failed = append(failed, reloadError{src, err})
+			if pacs[i] == nil {
+				pacs[i] = directPac()
+			}
+			continue
+		}
+
+		if pacs[i] != nil && pac.Source() == pacs[i].Source() {
+			s.logger.Printf("Pac file %s not changed", src)
+			continue
+		}
+
+		pacs[i] = pac
+		changed = true
+		s.logger.Printf("Refresh pac %s succeeded", src)
+	}
+
+	var err error
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	s.metrics.reloaded(err)
+
+	s.Lock()
+	old := s.pacs
+	s.reloadErr = err
+	if err == nil {
+		s.loadedAt = time.Now()
+	}
+
+	// proxies may have gone from the new pac, start with fresh transports
+	var transports map[string]roundTripper
+	if changed {
+		s.sources = sources
+		s.pacs = pacs
+		if s.cache != nil {
+			s.cache.purge()
+		}
+		s.breakers.reset()
+		s.latencies.reset()
+		s.drains.reset()
+		transports = s.transports
+		s.transports = make(map[string]roundTripper)
+	}
+	s.Unlock()
+	closeTransports(transports)
+
+	// callbacks run unlocked so they may call back into Server
+	if s.onReload != nil && changed {
+		for i := range pacs {
+			var prev *gpac.Parser
+			if i < len(old) {
+				prev = old[i]
+			}
+			if pacs[i] != prev {
+				s.onReload(prev, pacs[i])
+			}
+		}
+	}
+	if s.onReloadError != nil {
+		for _, f := range failed {
+			s.onReloadError(f.src, f.err)
+		}
+	}
+
+	return changed, err
+}
+
+// reloadError records a pac file which failed to reload
+type reloadError struct {
+	src string
+	err error
+}
+
+// Validate checks that FindProxyForURL of every loaded pac evaluates
+func (s *Server) Validate() error {
+	s.Lock()
+	sources, pacs := s.sources, s.pacs
+	s.Unlock()
+
+	for i, pac := range pacs {
+		if err := validatePac(pac, s.pacTimeout); err != nil {
+			return fmt.Errorf("%s: %v", sources[i], err)
+		}
+	}
+	return nil
+}
+
+// watch reloads pac files every refreshDuration until Shutdown
+func (s *Server) watch() {
+	ticker := time.NewTicker(s.refreshDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Reload()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Start starts the proxy server. Listeners are bound and the tls
+// certificate is loaded before anything else starts, so an address in
+// use or a bad certificate fails Start at once, before OnReady.
+func (s *Server) Start() error {
+	if s.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.tlsCert, s.tlsKey)
+		if err != nil {
+			return err
+		}
+		if s.TLSConfig == nil {
+			s.TLSConfig = new(tls.Config)
+		}
+		s.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	listeners, err := s.listenAll()
+	if err != nil {
+		return err
+	}
+
+	if s.metricsAddr != "" {
+		if err := s.listenMetrics(); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+	}
+
+	if s.refreshDuration > 0 && isStdin(s.sources) && !s.wpad {
+		s.logger.Printf("Pac is read from stdin, refresh disabled")
+	} else if s.refreshDuration > 0 {
+		s.logger.Printf("Start pac file watcher on: %s, refresh time: %v", strings.Join(sourceNames(s.sources), ","), s.refreshDuration)
+		go s.watch()
+	}
+	if s.socksAddr != "" {
+		l, err := s.bind(s.socksAddr, func() (net.Listener, error) {
+			return net.Listen("tcp", s.socksAddr)
+		})
+		if err != nil {
+			s.logger.Printf("Socks listener failed: %v", err)
+		} else {
+			go s.serveSocks(l)
+		}
+	}
+	s.Handler = s
+
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if s.tlsCert != "" {
+				errc <- s.ServeTLS(l, "", "")
+				return
+			}
+			errc <- s.Serve(l)
+		}(l)
+	}
+
+	if s.onReady != nil {
+		s.onReady()
+	}
+	return <-errc
+}
+
+// listenAll binds the proxy listeners, all listeners are served by
+// the same http.Server and Shutdown closes them all
+func (s *Server) listenAll() ([]net.Listener, error) {
+	addrs := strings.Split(s.Addr, ",")
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		s.Lock()
+		_, inherited := s.inherited[addr]
+		s.Unlock()
+
+		l, err := s.bind(addr, func() (net.Listener, error) {
+			return s.listen(addr)
+		})
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, unwrapListen(err))
+		}
+		if tl, ok := l.(*net.TCPListener); ok && inherited && s.keepAlive != 0 {
+			l = keepAliveListener{tl, s.keepAlive}
+		}
+		listeners = append(listeners, l)
+	}
+	s.closeInherited()
+
+	s.Lock()
+	for _, l := range listeners {
+		s.logger.Printf("Start proxy on %s", l.Addr())
+		s.bound = append(s.bound, l.Addr())
+	}
+	s.Unlock()
+	return listeners, nil
+}
+
+// unwrapListen drops the "listen tcp addr: bind:" prefixes of
+// listen errors, which repeat the address already reported
+func unwrapListen(err error) error {
+	var oe *net.OpError
+	if !errors.As(err, &oe) {
+		return err
+	}
+	if se, ok := oe.Err.(*os.SyscallError); ok {
+		return se.Err
+	}
+	return oe.Err
+}
+
+// ListenAddr returns the address of the first proxy listener, which has
+// the actual port when listening on port 0. It is nil until Start bound it.
+func (s *Server) ListenAddr() net.Addr {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.bound) == 0 {
+		return nil
+	}
+	return s.bound[0]
+}
+
+// listen creates a proxy listener, accepted tcp conns use keepAlive
+func (s *Server) listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return listenUnix(strings.TrimPrefix(addr, unixPrefix))
+	}
+
+	if addr == "" {
+		addr = ":http"
+		if s.tlsCert != "" {
+			addr = ":https"
+		}
+	}
+
+	lc := net.ListenConfig{KeepAlive: s.keepAlive, Control: s.listenControl()}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// Shutdown gracefully shuts down the server, hijacked CONNECT tunnels
+// are not tracked by http.Server so they are waited separately until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	s.quitOnce.Do(func() { close(s.quit) })
+
+	s.Lock()
+	if s.socks != nil {
+		s.socks.Close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	closeTransports(s.transports)
+	s.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.tunnels.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// New create the proxy server
+func New(opts Options) (*Server, error) {
+	var loadedAt time.Time
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	accessLog := opts.AccessLog
+	if accessLog == nil {
+		accessLog = os.Stderr
+	}
+
+	logFormat := opts.LogFormat
+	if logFormat == "" {
+		logFormat = "text"
+	}
+	if logFormat != "text" && logFormat != "json" {
+		return nil, fmt.Errorf("unknown log format: %s", logFormat)
+	}
+
+	pacMerge := opts.PacMerge
+	if pacMerge == "" {
+		pacMerge = MergeFirst
+	}
+	if pacMerge != MergeFirst && pacMerge != MergeConcat {
+		return nil, fmt.Errorf("unknown pac merge strategy: %s", pacMerge)
+	}
+
+	pacURLForm := opts.PacURL
+	if pacURLForm == "" {
+		pacURLForm = PacURLFull
+	}
+	if pacURLForm != PacURLFull && pacURLForm != PacURLHost {
+		return nil, fmt.Errorf("unknown pac url form: %s", pacURLForm)
+	}
+
+	network, err := ipNetwork(opts.IPVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	var nextHop *gpac.Proxy
+	if opts.NextHop != "" {
+		if _, _, err := net.SplitHostPort(opts.NextHop); err != nil {
+			return nil, fmt.Errorf("invalid next hop %s: %v", opts.NextHop, err)
+		}
+		nextHop = &gpac.Proxy{Type: "PROXY", Address: opts.NextHop}
+	}
+
+	if (opts.TLSCert == "") != (opts.TLSKey == "") {
+		return nil, errors.New("tls cert and key must be set together")
+	}
+
+	allow, err := parseAllowList(opts.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	forceAllow, err := parseAllowList(opts.ForceAllow)
+	if err != nil {
+		return nil, err
+	}
+
+	connectPorts, err := parsePortList(opts.ConnectPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if opts.ClientCA != "" {
+		if opts.TLSCert == "" {
+			return nil, errors.New("client ca requires tls cert")
+		}
+		if tlsConfig, err = clientCAConfig(opts.ClientCA); err != nil {
+			return nil, err
+		}
+	}
+
+	dial := directDialer.DialContext
+	if opts.Dialer != nil {
+		dial = opts.Dialer
+	}
+	fetcher := newFetcher(dial, opts.UserAgent)
+
+	fallbackSources := splitSources(opts.PacSource)
+	sources := opts.PacSources
+	if len(sources) == 0 && opts.Finder == nil {
+		names := fallbackSources
+		if opts.WPAD {
+			names = wpadSources(logger, opts.FetchTimeout, fetcher, fallbackSources)
+		}
+		sources = newSources(names, fetcher)
+	}
+	for _, source := range sources {
+		if h, ok := source.(*httpSource); ok && h.fetcher == nil {
+			h.fetcher = fetcher
+		}
+	}
+	pacs := make([]*gpac.Parser, len(sources))
+	var loadErr error // of pac files falling back to direct
+
+	for i, source := range sources {
+		src := source.String()
+		_, local := source.(*fileSource)
+
+		pac, err := loadPac(source, opts.FetchTimeout)
+		if err != nil {
+			forget(source)
+		}
+		if opts.Strict {
+			if err == nil {
+				err = validatePac(pac, opts.PacTimeout)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", src, err)
+			}
+		} else if os.IsNotExist(err) {
+			logger.Printf("Warn: %s not found, using direct connection", src)
+			pac = directPac()
+			loadErr = fmt.Errorf("%s: %v", src, err)
+		} else if err != nil && !local {
+			// remote pac may come back later, the watcher will pick it up
+			logger.Printf("Warn: load %s failed: %v, using direct connection", src, err)
+			pac = directPac()
+			loadErr = fmt.Errorf("%s: %v", src, err)
+		} else if err != nil {
+			return nil, err
+		}
+		pacs[i] = pac
+	}
+
+	if loadErr == nil {
+		loadedAt = time.Now()
+	}
+
+	s := &Server{
+		Server: http.Server{
+			Addr:              opts.Addr,
+			ReadHeaderTimeout: opts.ReadHeaderTimeout,
+			MaxHeaderBytes:    opts.MaxHeaderBytes,
+			TLSConfig:         tlsConfig,
+		},
+		pacs:             pacs,
+		transports:       make(map[string]roundTripper),
+		sources:          sources,
+		pacMerge:         pacMerge,
+		pacURLForm:       pacURLForm,
+		refreshDuration:  opts.RefreshInterval,
+		fetchTimeout:     opts.FetchTimeout,
+		fetcher:          fetcher,
+		pacTimeout:       opts.PacTimeout,
+		dialTimeout:      opts.DialTimeout,
+		retries:          opts.Retries,
+		retryBackoff:     opts.RetryBackoff,
+		readTimeout:      opts.ReadTimeout,
+		headerTimeout:    opts.ResponseHeaderTimeout,
+		keepAlive:        opts.KeepAlive,
+		reusePort:        opts.ReusePort,
+		fastOpen:         opts.FastOpen,
+		idleConnTimeout:  opts.IdleConnTimeout,
+		maxIdleConns:     opts.MaxIdleConns,
+		maxBodyBytes:     opts.MaxBodyBytes,
+		tunnelIdle:       opts.TunnelIdle,
+		metricsAddr:      opts.MetricsAddr,
+		metricsRequired:  opts.MetricsRequired,
+		logFormat:        logFormat,
+		ipNetwork:        network,
+		slowThreshold:    opts.SlowThreshold,
+		auth:             opts.Credentials,
+		allow:            allow,
+		forceAllow:       forceAllow,
+		requestIDHeader:  http.CanonicalHeaderKey(opts.RequestIDHeader),
+		drains:           newDrains(),
+		forceClients:     make(map[string]bool),
+		upstreamAuth:     opts.UpstreamAuth,
+		upstreamInsecure: opts.UpstreamInsecure,
+		upstreamNTLM:     opts.UpstreamNTLM,
+		overrides:        opts.Overrides,
+		noProxy:          parseNoProxy(opts.NoProxy),
+		connectPorts:     connectPorts,
+		finder:           opts.Finder,
+		connectSchemes:   opts.ConnectSchemes,
+		nextHop:          nextHop,
+		healthPath:       opts.HealthPath,
+		pacPath:          opts.PacPath,
+		directFallback:   opts.DirectFallback,
+		verboseErrors:    opts.VerboseErrors,
+		via:              opts.Via,
+		stripHeaders:     opts.StripHeaders,
+		hopHeaders:       opts.HopHeaders,
+		responseHeaders:  opts.ResponseHeaders,
+		noXFF:            opts.NoXFF,
+		blockMethods:     make(map[string]bool),
+		strict:           opts.Strict,
+		wpad:             opts.WPAD && len(opts.PacSources) == 0 && opts.Finder == nil,
+		fallbackSources:  fallbackSources,
+		tlsCert:          opts.TLSCert,
+		tlsKey:           opts.TLSKey,
+		rateLimit:        opts.RateLimit,
+		maxConnsPerProxy: opts.MaxConnsPerProxy,
+		limitWait:        opts.ProxyLimitWait,
+		conns:            make(map[string]chan struct{}),
+		onReload:         opts.OnReload,
+		onReloadError:    opts.OnReloadError,
+		onReady:          opts.OnReady,
+		socksAddr:        opts.SocksAddr,
+		inherited:        make(map[string]net.Listener),
+		listeners:        make(map[string]net.Listener),
+		loadedAt:         loadedAt,
+		reloadErr:        loadErr,
+		logger:           logger,
+		accessLog:        accessLog,
+		dial:             dial,
+		buildInfo:        opts.BuildInfo,
+		metrics:          newMetrics(),
+		quit:             make(chan struct{}),
+		stats:            new(stats),
+	}
+
+	for addr, l := range opts.Listeners {
+		s.inherited[addr] = l
+	}
+
+	s.metrics.reloaded(loadErr)
+
+	for _, name := range opts.ForceClients {
+		s.forceClients[name] = true
+	}
+
+	for _, method := range opts.BlockMethods {
+		s.blockMethods[strings.ToUpper(method)] = true
+	}
+
+	if opts.MaxClients > 0 {
+		s.clients = make(chan struct{}, opts.MaxClients)
+	}
+
+	if opts.CacheSize > 0 {
+		s.cache = newProxyCache(opts.CacheSize, opts.CacheTTL)
+	}
+
+	if opts.DNSCacheTTL > 0 {
+		s.dns = newDNSCache(opts.DNSCacheTTL)
+	}
+
+	if opts.BreakerThreshold > 0 {
+		s.breakers = newBreakers(opts.BreakerThreshold, opts.BreakerCooldown)
+	}
+
+	if opts.SmartSelect {
+		s.latencies = newLatencies()
+	}
+
+	// an empty map keeps ServeTLS from negotiating http/2
+	if opts.TLSCert != "" && opts.DisableHTTP2 {
+		s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	if opts.RateLimit > 0 && opts.RateLimitShared {
+		s.sharedLimiter = rate.NewLimiter(rate.Limit(opts.RateLimit), opts.RateLimit)
+	}
+
+	return s, nil
+}
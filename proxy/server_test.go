@@ -0,0 +1,407 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/darren/gpac"
+)
+
+// finderFunc fakes pac with a function
+type finderFunc func(urlstr string) ([]*gpac.Proxy, error)
+
+func (f finderFunc) FindProxy(urlstr string) ([]*gpac.Proxy, error) {
+	return f(urlstr)
+}
+
+// staticFinder returns the proxies of directive for every url
+func staticFinder(directive string) PacFinder {
+	return finderFunc(func(string) ([]*gpac.Proxy, error) {
+		return gpac.ParseProxy(directive), nil
+	})
+}
+
+// newTestProxy creates a proxy configured by opts, its logs are discarded
+func newTestProxy(t *testing.T, opts Options) *Server {
+	t.Helper()
+	if opts.Logger == nil {
+		opts.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	if opts.AccessLog == nil {
+		opts.AccessLog = ioutil.Discard
+	}
+
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newTestServer serves a proxy configured by opts
+func newTestServer(t *testing.T, opts Options) (*Server, *httptest.Server) {
+	t.Helper()
+	s := newTestProxy(t, opts)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// proxyClient returns a client sending all requests through the proxy at ts
+func proxyClient(t *testing.T, ts *httptest.Server) *http.Client {
+	t.Helper()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+// newOrigin serves body on every path
+func newOrigin(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	return newOriginFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+}
+
+// newOriginFunc serves handler on every path
+func newOriginFunc(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// upstream is an http proxy connecting directly, counting requests
+type upstream struct {
+	addr     string
+	requests int64
+}
+
+func newUpstream(t *testing.T) *upstream {
+	t.Helper()
+	return startUpstream(t, httptest.NewServer)
+}
+
+// startUpstream starts the upstream with start, eg: httptest.NewTLSServer
+func startUpstream(t *testing.T, start func(http.Handler) *httptest.Server) *upstream {
+	t.Helper()
+	u := new(upstream)
+	s := newTestProxy(t, Options{Finder: staticFinder("DIRECT")})
+	counted := start(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&u.requests, 1)
+		s.ServeHTTP(w, r)
+	}))
+	t.Cleanup(counted.Close)
+	u.addr = counted.Listener.Addr().String()
+	return u
+}
+
+func (u *upstream) count() int64 {
+	return atomic.LoadInt64(&u.requests)
+}
+
+// deadAddr returns an address nothing listens on
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: read body: %v", url, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestServeHTTPRouting(t *testing.T) {
+	origin := newOrigin(t, "hello")
+	tlsOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer tlsOrigin.Close()
+	up := newUpstream(t)
+
+	var mu sync.Mutex
+	var asked []string
+	finder := finderFunc(func(urlstr string) ([]*gpac.Proxy, error) {
+		mu.Lock()
+		asked = append(asked, urlstr)
+		mu.Unlock()
+		if strings.Contains(urlstr, "via=proxy") || strings.HasPrefix(urlstr, "https:") {
+			return gpac.ParseProxy("PROXY " + up.addr), nil
+		}
+		return gpac.ParseProxy("DIRECT"), nil
+	})
+	_, ts := newTestServer(t, Options{Finder: finder})
+	client := proxyClient(t, ts)
+
+	tests := []struct {
+		url      string
+		body     string
+		upstream int64 // requests the upstream proxy got
+	}{
+		{origin.URL + "/direct", "hello", 0},
+		{origin.URL + "/?via=proxy", "hello", 1},
+		{tlsOrigin.URL + "/", "secure", 2},
+	}
+
+	for _, tt := range tests {
+		code, body := get(t, client, tt.url)
+		if code != http.StatusOK || body != tt.body {
+			t.Errorf("GET %s = %d %q, want 200 %q", tt.url, code, body, tt.body)
+		}
+		if n := up.count(); n != tt.upstream {
+			t.Errorf("GET %s: upstream got %d requests, want %d", tt.url, n, tt.upstream)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "https://" + tlsOrigin.Listener.Addr().String() + "/"
+	if len(asked) != 3 || asked[2] != want {
+		t.Errorf("pac asked for %q, want CONNECT as %s", asked, want)
+	}
+}
+
+func TestServeHTTPFailover(t *testing.T) {
+	origin := newOrigin(t, "hello")
+	up := newUpstream(t)
+
+	_, ts := newTestServer(t, Options{Finder: staticFinder("PROXY " + deadAddr(t) + "; PROXY " + up.addr)})
+	client := proxyClient(t, ts)
+
+	code, body := get(t, client, origin.URL)
+	if code != http.StatusOK || body != "hello" {
+		t.Fatalf("GET = %d %q, want 200 hello", code, body)
+	}
+	if up.count() != 1 {
+		t.Errorf("upstream got %d requests, want 1", up.count())
+	}
+}
+
+func TestServeHTTPDirectFallback(t *testing.T) {
+	origin := newOrigin(t, "hello")
+	finder := staticFinder("PROXY " + deadAddr(t))
+
+	tests := []struct {
+		fallback bool
+		code     int
+	}{
+		{false, http.StatusBadGateway},
+		{true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		_, ts := newTestServer(t, Options{Finder: finder, DirectFallback: tt.fallback})
+		client := proxyClient(t, ts)
+
+		if code, _ := get(t, client, origin.URL); code != tt.code {
+			t.Errorf("DirectFallback %v: GET = %d, want %d", tt.fallback, code, tt.code)
+		}
+	}
+}
+
+func TestServeHTTPPostFailover(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer echo.Close()
+
+	// consuming reads the whole request, then drops the conn
+	var consumed int64
+	consuming := newOriginFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		atomic.AddInt64(&consumed, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+
+	tests := []struct {
+		first   string // proxy failing before DIRECT
+		size    int
+		retries int
+		code    int
+	}{
+		{deadAddr(t), 5, 0, http.StatusOK},
+		{deadAddr(t), maxReplayBody + 1, 0, http.StatusOK},
+		{consuming.Listener.Addr().String(), 5, 0, http.StatusOK},
+		{consuming.Listener.Addr().String(), 5, 1, http.StatusOK},
+		// a large body is gone once read, it is not sent again
+		{consuming.Listener.Addr().String(), maxReplayBody + 1, 0, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		atomic.StoreInt64(&consumed, 0)
+		opts := Options{Finder: staticFinder("PROXY " + tt.first + "; DIRECT"), Retries: tt.retries, BreakerThreshold: 10}
+		s, ts := newTestServer(t, opts)
+		client := proxyClient(t, ts)
+
+		payload := strings.Repeat("x", tt.size)
+		resp, err := client.Post(echo.URL, "text/plain", strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code || tt.code == http.StatusOK && string(body) != payload {
+			t.Errorf("POST of %d bytes via %s, retries %d = %d with %d bytes, want %d echoed",
+				tt.size, tt.first, tt.retries, resp.StatusCode, len(body), tt.code)
+		}
+		if tt.first == consuming.Listener.Addr().String() && tt.code == http.StatusOK {
+			if n := atomic.LoadInt64(&consumed); n != int64(1+tt.retries) {
+				t.Errorf("POST of %d bytes, retries %d: upstream read %d bodies, want %d", tt.size, tt.retries, n, 1+tt.retries)
+			}
+		}
+		// DIRECT succeeded, it must not be charged with the failure
+		if st := s.breakers.status()["DIRECT"]; st.Failures != 0 && tt.code == http.StatusOK {
+			t.Errorf("DIRECT breaker = %+v after a successful POST", st)
+		}
+	}
+}
+
+func TestServeHTTPRejectsLocalFailures(t *testing.T) {
+	up := newUpstream(t)
+	s, ts := newTestServer(t, Options{Finder: staticFinder("PROXY " + up.addr), BreakerThreshold: 1})
+
+	for _, req := range []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(req))
+		buf := make([]byte, 12)
+		n, _ := conn.Read(buf)
+		conn.Close()
+		if got := string(buf[:n]); got != "HTTP/1.1 400" {
+			t.Errorf("%q = %q, want HTTP/1.1 400", strings.SplitN(req, "\r\n", 2)[0], got)
+		}
+	}
+
+	if status := s.breakers.status(); len(status) != 0 {
+		t.Errorf("breakers = %v, want none", status)
+	}
+}
+
+func TestServeHTTPAllowUnix(t *testing.T) {
+	origin := newOrigin(t, "hello")
+	dir, err := ioutil.TempDir("", "pacroxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestProxy(t, Options{Finder: staticFinder("DIRECT"), Allow: "192.0.2.0/24"})
+	tcp := httptest.NewServer(s)
+	defer tcp.Close()
+	l, err := listenUnix(filepath.Join(dir, "proxy.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix := &httptest.Server{Listener: l, Config: &http.Server{Handler: s}}
+	unix.Start()
+	defer unix.Close()
+
+	if code, _ := get(t, proxyClient(t, tcp), origin.URL); code != http.StatusForbidden {
+		t.Errorf("tcp client not in allow list: GET = %d, want 403", code)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "pacroxy"}),
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", l.Addr().String())
+		},
+	}}
+	if code, body := get(t, client, origin.URL); code != http.StatusOK || body != "hello" {
+		t.Errorf("unix client: GET = %d %q, want 200 hello", code, body)
+	}
+}
+
+func TestPacFetchUsesDialer(t *testing.T) {
+	pac := newOrigin(t, `function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	for i, opts := range []Options{
+		{PacSource: pac.URL + "/proxy.pac"},
+		{PacSources: []Source{NewHTTPSource(pac.URL + "/proxy.pac")}},
+	} {
+		var dials int64
+		opts.Strict = true
+		opts.Dialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt64(&dials, 1)
+			return new(net.Dialer).DialContext(ctx, network, address)
+		}
+		newTestProxy(t, opts)
+		if atomic.LoadInt64(&dials) == 0 {
+			t.Errorf("case %d: pac fetched without Dialer", i)
+		}
+	}
+}
+
+func TestServeHTTPFailoverClosesAbandoned(t *testing.T) {
+	abandoned := make(chan struct{})
+	// slow does not answer within the header timeout, it notices when
+	// the attempt is abandoned by its conn being closed
+	slow := newOriginFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(abandoned)
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("too late"))
+		}
+	})
+	// origin only answers once the abandoned attempt was closed, so a
+	// body left open until the handler returns would time it out
+	origin := newOriginFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-abandoned:
+			w.Write([]byte("hello"))
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	})
+
+	_, ts := newTestServer(t, Options{
+		Finder:                staticFinder("PROXY " + slow.Listener.Addr().String() + "; DIRECT"),
+		ResponseHeaderTimeout: 100 * time.Millisecond,
+	})
+	if code, body := get(t, proxyClient(t, ts), origin.URL); code != http.StatusOK || body != "hello" {
+		t.Errorf("GET = %d %q, want 200 hello after the abandoned attempt was closed", code, body)
+	}
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"syscall"
+)
+
+// listenControl returns the net.ListenConfig Control setting the socket
+// options of proxy listeners, nil if none are configured
+func (s *Server) listenControl() func(network, address string, c syscall.RawConn) error {
+	if !s.reusePort && s.fastOpen <= 0 {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if s.reusePort {
+				if err = setReusePort(fd); err != nil {
+					return
+				}
+			}
+			if s.fastOpen > 0 {
+				err = setFastOpen(fd, s.fastOpen)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
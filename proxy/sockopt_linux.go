@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setReusePort lets other sockets bind the same address, so a restarted
+// proxy can listen while the old one is still draining
+func setReusePort(fd uintptr) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1))
+}
+
+// setFastOpen enables TCP Fast Open with a queue of qlen pending conns
+func setFastOpen(fd uintptr, qlen int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, qlen))
+}
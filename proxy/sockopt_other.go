@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import "errors"
+
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT is only supported on linux")
+}
+
+func setFastOpen(fd uintptr, qlen int) error {
+	return errors.New("TCP Fast Open is only supported on linux")
+}
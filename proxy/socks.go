@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 constants, see RFC 1928
+const (
+	socksVersion5 = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4 = 0x01
+	socksAddrFQDN = 0x03
+	socksAddrIPv6 = 0x04
+
+	socksSucceeded          = 0x00
+	socksNotAllowed         = 0x02
+	socksHostUnreachable    = 0x04
+	socksCmdNotSupported    = 0x07
+	socksAddrTypeNotSupport = 0x08
+)
+
+// socksHandshakeTimeout limits how long a client may take to
+// negotiate and send its request
+const socksHandshakeTimeout = 30 * time.Second
+
+var errSocksVersion = errors.New("socks: unsupported version")
+
+// serveSocks serves the socks5 listener
+func (s *Server) serveSocks(l net.Listener) {
+	s.Lock()
+	s.socks = l
+	s.Unlock()
+
+	s.logger.Printf("Start socks5 proxy on %s", l.Addr())
+	if len(s.auth) > 0 {
+		s.logger.Println("Warn: socks5 listener does not require authentication")
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			s.logger.Printf("Socks listener stopped: %v", err)
+			return
+		}
+		go s.handleSocks(conn)
+	}
+}
+
+// handleSocks serves a single socks5 client, only no-auth and CONNECT are supported
+func (s *Server) handleSocks(conn net.Conn) {
+	defer s.recoverConn(conn, "SOCKS5")
+	start := time.Now()
+	s.metrics.request("SOCKS5")
+
+	if !fromUnix(conn.LocalAddr()) && !s.allow.allows(conn.RemoteAddr().String()) {
+		s.logger.Printf("[%s] SOCKS5 rejected: client not allowed", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(start.Add(socksHandshakeTimeout))
+	br := bufio.NewReader(conn)
+
+	hostport, err := socksHandshake(br, conn)
+	if err != nil {
+		s.logger.Printf("[%s] SOCKS5 handshake failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	url := s.connectURL(hostport)
+	rec := &accessRecord{ID: newRequestID(), Remote: conn.RemoteAddr().String(), Method: "SOCKS5", URL: url, Authority: hostport}
+
+	if !s.connectPorts.allows(hostport) {
+		socksReply(conn, socksNotAllowed)
+		conn.Close()
+		rec.Error = "port not allowed"
+		s.logRequest(rec, start)
+		return
+	}
+
+	dst, proxy, err := s.dialTarget(context.Background(), rec, url, hostport)
+	if err != nil {
+		socksReply(conn, socksHostUnreachable)
+		conn.Close()
+		rec.Error = err.Error()
+		s.logRequest(rec, start)
+		return
+	}
+	rec.Proxy = proxy.String()
+
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		conn.Close()
+		dst.Close()
+		rec.Error = err.Error()
+		s.logRequest(rec, start)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.tunnels.Add(1)
+	defer s.tunnels.Done()
+	defer s.stats.begin(&s.stats.ActiveTunnels)()
+
+	rec.setup = time.Since(start)
+	dst, client := s.throttle(dst, combine(br, conn))
+	rec.Sent, rec.Received = tunnel(dst, client, s.tunnelIdle)
+	s.metrics.tunnel(rec.Sent, rec.Received)
+	s.logRequest(rec, start)
+}
+
+// socksHandshake negotiates no-auth and reads the CONNECT request,
+// it returns the requested host:port
+func socksHandshake(r io.Reader, w io.Writer) (string, error) {
+	var b [4]byte
+
+	// greeting: VER NMETHODS METHODS...
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return "", err
+	}
+	if b[0] != socksVersion5 {
+		return "", errSocksVersion
+	}
+
+	methods := make([]byte, b[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		if m == socksAuthNone {
+			method = socksAuthNone
+			break
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion5, method}); err != nil {
+		return "", err
+	}
+	if method == socksAuthNoAcceptable {
+		return "", errors.New("socks: no acceptable authentication methods")
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return "", err
+	}
+	if b[0] != socksVersion5 {
+		return "", errSocksVersion
+	}
+	if b[1] != socksCmdConnect {
+		socksReply(w, socksCmdNotSupported)
+		return "", fmt.Errorf("socks: command %d not supported", b[1])
+	}
+
+	var host string
+	switch b[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if b[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrFQDN:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return "", err
+		}
+		name := make([]byte, b[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(w, socksAddrTypeNotSupport)
+		return "", fmt.Errorf("socks: address type %d not supported", b[3])
+	}
+
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return "", err
+	}
+	port := int(b[0])<<8 | int(b[1])
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// socksReply writes a reply with rep code, bound address is always 0.0.0.0:0
+func socksReply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socksVersion5, rep, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
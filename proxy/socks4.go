@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS4 and SOCKS4a constants
+const (
+	socksVersion4 = 0x04
+
+	socks4Granted = 0x5a
+)
+
+// socks4Dial connects to address through the SOCKS4 proxy at proxyAddr
+// reached with dial, host names are resolved by the proxy with the SOCKS4a extension
+func socks4Dial(ctx context.Context, dial dialFunc, proxyAddr, address string) (net.Conn, error) {
+	host, portstr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks4: invalid port %s", portstr)
+	}
+
+	// VN CD DSTPORT DSTIP USERID NUL [HOST NUL]
+	req := []byte{socksVersion4, socksCmdConnect, byte(port >> 8), byte(port)}
+	if ip := net.ParseIP(host); ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, errors.New("socks4: ipv6 address not supported")
+		}
+		req = append(req, ip4...)
+		req = append(req, 0)
+	} else {
+		req = append(req, 0, 0, 0, 1, 0)
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	conn, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// VN CD DSTPORT DSTIP
+	var resp [8]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp[1] != socks4Granted {
+		conn.Close()
+		return nil, fmt.Errorf("socks4: %s rejected CONNECT %s: code %#x", proxyAddr, address, resp[1])
+	}
+	return conn, nil
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Source is where a pac file is loaded from, implement it to load pac
+// files from other backends and pass it in Options.PacSources
+type Source interface {
+	// Load returns the pac text, or ErrNotModified when it did not change
+	// since the last Load. Calls are never concurrent.
+	Load(ctx context.Context) (string, error)
+	// String names the source in logs
+	String() string
+}
+
+// ErrNotModified is returned by Source.Load when the pac did not change
+var ErrNotModified = errors.New("pac not modified")
+
+// resetter is implemented by sources which remember what they loaded,
+// reset makes the next Load return the pac even if it did not change
+type resetter interface {
+	reset()
+}
+
+// stdinSource is the pac source read from stdin
+const stdinSource = "-"
+
+// fetcher fetches remote pac files, connecting with the dialer of
+// Options.Dialer instead of following the proxy environment
+type fetcher struct {
+	client    *http.Client
+	userAgent string // empty sends the net/http default
+}
+
+func newFetcher(dial dialFunc, userAgent string) *fetcher {
+	return &fetcher{
+		client: &http.Client{Transport: &http.Transport{
+			DialContext:         dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+		userAgent: userAgent,
+	}
+}
+
+// newSource returns the source of a pac file path, http(s) url or - for stdin,
+// remote ones are fetched with f
+func newSource(src string, f *fetcher) Source {
+	switch {
+	case isRemote(src):
+		return &httpSource{url: src, fetcher: f}
+	case src == stdinSource:
+		return &stdinPac{}
+	default:
+		return NewFileSource(src)
+	}
+}
+
+func newSources(srcs []string, f *fetcher) []Source {
+	sources := make([]Source, len(srcs))
+	for i, src := range srcs {
+		sources[i] = newSource(src, f)
+	}
+	return sources
+}
+
+func sourceNames(sources []Source) []string {
+	names := make([]string, len(sources))
+	for i, source := range sources {
+		names[i] = source.String()
+	}
+	return names
+}
+
+// fileSource loads a local pac file, files whose mtime and size did not
+// change are not read again
+type fileSource struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// NewFileSource returns the Source of a local pac file
+func NewFileSource(path string) Source {
+	return &fileSource{path: path}
+}
+
+func (f *fileSource) Load(ctx context.Context) (string, error) {
+	// stat before reading so a change in between is seen next time
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		f.reset()
+		return "", err
+	}
+	if !f.modTime.IsZero() && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return "", ErrNotModified
+	}
+
+	buf, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		f.reset()
+		return "", err
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return string(buf), nil
+}
+
+func (f *fileSource) reset() {
+	f.modTime, f.size = time.Time{}, 0
+}
+
+func (f *fileSource) String() string {
+	return f.path
+}
+
+// httpSource fetches a remote pac file, requests are conditional on the
+// validators of the last response
+type httpSource struct {
+	url          string
+	fetcher      *fetcher // nil uses http.DefaultClient, New sets it
+	etag         string
+	lastModified string
+}
+
+// NewHTTPSource returns the Source of a pac file served at an http(s) url,
+// non 200 responses are errors instead of being handed to the parser.
+// In Options.PacSources it is fetched with Options.Dialer.
+func NewHTTPSource(url string) Source {
+	return &httpSource{url: url}
+}
+
+func (h *httpSource) Load(ctx context.Context) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return "", err
+	}
+	client := http.DefaultClient
+	if h.fetcher != nil {
+		client = h.fetcher.client
+		if h.fetcher.userAgent != "" {
+			req.Header.Set("User-Agent", h.fetcher.userAgent)
+		}
+	}
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+	if h.lastModified != "" {
+		req.Header.Set("If-Modified-Since", h.lastModified)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && (h.etag != "" || h.lastModified != "") {
+		return "", ErrNotModified
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch %s: unexpected status %s", h.url, resp.Status)
+	}
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("fetch %s: %v", h.url, err)
+	}
+
+	h.etag, h.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return string(buf), nil
+}
+
+func (h *httpSource) reset() {
+	h.etag, h.lastModified = "", ""
+}
+
+func (h *httpSource) String() string {
+	return h.url
+}
+
+// stdinPac reads the pac from stdin once, later loads
+// return ErrNotModified as there is nothing more to read
+type stdinPac struct {
+	done bool
+}
+
+func (p *stdinPac) Load(ctx context.Context) (string, error) {
+	if p.done {
+		return "", ErrNotModified
+	}
+	buf, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("read pac from stdin: %v", err)
+	}
+	p.done = true
+	return string(buf), nil
+}
+
+func (p *stdinPac) String() string {
+	return stdinSource
+}
+
+// isStdin tests whether sources only read stdin, which is never refreshed
+func isStdin(sources []Source) bool {
+	if len(sources) != 1 {
+		return false
+	}
+	_, ok := sources[0].(*stdinPac)
+	return ok
+}
+
+// isRemote tests whether the pac source is an http(s) url
+func isRemote(src string) bool {
+	return strings.HasPrefix(src, "http://") ||
+		strings.HasPrefix(src, "https://")
+}
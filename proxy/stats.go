@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// stats are live counters served on /stats, all fields are updated
+// atomically and must stay 64-bit aligned
+type stats struct {
+	ActiveTunnels  int64 `json:"active_tunnels"`
+	ActiveRequests int64 `json:"active_requests"`
+	ActiveClients  int64 `json:"active_clients"` // requests and tunnels being handled
+	BytesSent      int64 `json:"bytes_sent"`
+	BytesReceived  int64 `json:"bytes_received"`
+}
+
+// begin increments counter and returns the func to decrement it again
+func (st *stats) begin(counter *int64) func() {
+	atomic.AddInt64(counter, 1)
+	return func() {
+		atomic.AddInt64(counter, -1)
+	}
+}
+
+// record adds the bytes transferred by a finished request
+func (st *stats) record(rec *accessRecord) {
+	atomic.AddInt64(&st.BytesSent, rec.Sent)
+	atomic.AddInt64(&st.BytesReceived, rec.Received)
+}
+
+func (st *stats) snapshot() stats {
+	return stats{
+		ActiveTunnels:  atomic.LoadInt64(&st.ActiveTunnels),
+		ActiveRequests: atomic.LoadInt64(&st.ActiveRequests),
+		ActiveClients:  atomic.LoadInt64(&st.ActiveClients),
+		BytesSent:      atomic.LoadInt64(&st.BytesSent),
+		BytesReceived:  atomic.LoadInt64(&st.BytesReceived),
+	}
+}
+
+// statsResult is the /stats response, breakers lists the
+// proxies which failed since they last succeeded, latencies
+// the proxies measured by smart select
+type statsResult struct {
+	stats
+	MaxClients int                      `json:"max_clients,omitempty"`
+	Breakers   map[string]breakerStatus `json:"breakers,omitempty"`
+	Latencies  map[string]latencyStatus `json:"latencies,omitempty"`
+	Drained    map[string]time.Time     `json:"drained,omitempty"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statsResult{s.stats.snapshot(), cap(s.clients), s.breakers.status(), s.latencies.status(), s.drains.status()})
+}
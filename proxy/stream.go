@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// streamConn adapts the body and ResponseWriter of an http/2 CONNECT
+// stream to net.Conn so it can be tunneled like a hijacked conn.
+// http/2 conns can not be hijacked, the stream is the tunnel instead.
+type streamConn struct {
+	body    io.ReadCloser
+	w       io.Writer
+	flusher http.Flusher
+	req     *http.Request
+}
+
+func newStreamConn(w http.ResponseWriter, r *http.Request) (*streamConn, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	return &streamConn{body: r.Body, w: w, flusher: flusher, req: r}, true
+}
+
+func (c *streamConn) Read(data []byte) (int, error) {
+	return c.body.Read(data)
+}
+
+// Write flushes every write so the peer receives data at once
+func (c *streamConn) Write(data []byte) (int, error) {
+	n, err := c.w.Write(data)
+	if err == nil {
+		c.flusher.Flush()
+	}
+	return n, err
+}
+
+// Close closes the request body, the stream itself ends
+// when the handler returns
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	if addr, ok := c.req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return nil
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.req.RemoteAddr)
+	return addr
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
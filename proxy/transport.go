@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/darren/gpac"
+)
+
+// roundTripper is implemented by http.Transport and ntlmTransport
+type roundTripper interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// transport returns the transport shared by all requests via proxy,
+// gpac returns new proxies on every lookup so they are keyed by address
+func (s *Server) transport(proxy *gpac.Proxy) roundTripper {
+	key := proxy.String()
+
+	s.Lock()
+	defer s.Unlock()
+
+	t, ok := s.transports[key]
+	if !ok {
+		t = s.newTransport(proxy)
+		s.transports[key] = t
+	}
+	return t
+}
+
+// newTransport creates the transport sending requests via proxy
+func (s *Server) newTransport(proxy *gpac.Proxy) roundTripper {
+	if creds, ok := s.ntlmProxy(s.hop(proxy)); ok {
+		// NTLM authenticates conns, which http.Transport can not do
+		dial := s.forward()
+		if proxy.IsDirect() {
+			dial = s.dialDirect
+		}
+		if s.hop(proxy).Type == "HTTPS" {
+			dial = s.tlsDialer(dial)
+		}
+		return &ntlmTransport{proxy: s.hop(proxy), creds: creds, dial: dial}
+	}
+
+	t := s.httpTransport(proxy)
+	// responses are relayed as they are, the transport must not ask
+	// for gzip on its own and hand back decoded bodies
+	t.DisableCompression = true
+
+	// conns via a proxy all go to the same host, the proxy,
+	// direct ones are spread over origins
+	if s.maxIdleConns > 0 {
+		t.MaxIdleConns = s.maxIdleConns
+		if !proxy.IsDirect() || s.nextHop != nil {
+			t.MaxIdleConnsPerHost = s.maxIdleConns
+		}
+	}
+	t.IdleConnTimeout = s.idleConnTimeout
+	return t
+}
+
+// httpTransport creates the http.Transport reaching origins via proxy
+func (s *Server) httpTransport(proxy *gpac.Proxy) *http.Transport {
+	switch {
+	case proxy.IsDirect() && s.nextHop != nil:
+		// requests go to the next hop as to any http proxy
+		return &http.Transport{Proxy: s.nextHop.Proxy(), DialContext: s.dialDirect}
+	case proxy.IsDirect(), proxy.IsSOCKS():
+		// net/http has no socks4 support and direct connections follow
+		// ip version and the dns cache, dial with our own dialer
+		return &http.Transport{DialContext: s.dialer(proxy)}
+	case proxy.Type == "HTTPS":
+		// the transport speaks plain http over the tls conn so that
+		// upstreamInsecure does not apply to the tls of origins
+		plain := &gpac.Proxy{Type: "PROXY", Address: proxy.Address}
+		return &http.Transport{Proxy: plain.Proxy(), DialContext: s.tlsDialer(s.forward())}
+	default:
+		// http proxies are reached through the next hop if there is one
+		return &http.Transport{Proxy: proxy.Proxy(), DialContext: s.forward()}
+	}
+}
+
+// hop returns the proxy receiving http requests sent via proxy
+func (s *Server) hop(proxy *gpac.Proxy) *gpac.Proxy {
+	if proxy.IsDirect() && s.nextHop != nil {
+		return s.nextHop
+	}
+	return proxy
+}
+
+// closeTransports closes idle connections of transports
+func closeTransports(transports map[string]roundTripper) {
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestGzipPassthrough(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(bytes.Repeat([]byte("hello "), 100))
+	zw.Close()
+
+	var mu sync.Mutex
+	var accepted []string
+	origin := newOriginFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		accepted = append(accepted, r.Header.Get("Accept-Encoding"))
+		mu.Unlock()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	})
+	up := newUpstream(t)
+
+	for _, directive := range []string{"DIRECT", "PROXY " + up.addr} {
+		_, ts := newTestServer(t, Options{Finder: staticFinder(directive)})
+		client := proxyClient(t, ts)
+		client.Transport.(*http.Transport).DisableCompression = true
+
+		for _, accept := range []string{"", "gzip"} {
+			req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+			if accept != "" {
+				req.Header.Set("Accept-Encoding", accept)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+				t.Errorf("%s, Accept-Encoding %q: Content-Encoding = %q, want gzip", directive, accept, enc)
+			}
+			if !bytes.Equal(body, gz.Bytes()) {
+				t.Errorf("%s, Accept-Encoding %q: got %d bytes, want the %d gzipped bytes unchanged", directive, accept, len(body), gz.Len())
+			}
+		}
+	}
+
+	// the proxy never asks for gzip on behalf of clients
+	mu.Lock()
+	defer mu.Unlock()
+	for i, accept := range accepted {
+		if want := []string{"", "gzip"}[i%2]; accept != want {
+			t.Errorf("request %d reached origin with Accept-Encoding %q, want %q", i, accept, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// combine combines conn and peeked buffer
+func combine(peeked io.Reader, conn net.Conn) *peekedConn {
+	r := io.MultiReader(peeked, conn)
+	return &peekedConn{conn, r}
+}
+
+func (p *peekedConn) Read(data []byte) (int, error) {
+	return p.r.Read(data)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// wrapper is implemented by conns wrapping another conn, closeWrite
+// unwraps them to reach the conn which can half close
+type wrapper interface {
+	unwrap() net.Conn
+}
+
+func (p *peekedConn) unwrap() net.Conn {
+	return p.Conn
+}
+
+// tunnelLinger is how long the remaining direction of a tunnel is waited
+// for after both conns were closed, as Close does not interrupt every
+// copy, eg: one writing to an http/2 stream. A var so tests can shorten it.
+var tunnelLinger = 30 * time.Second
+
+// tunnel copies data between src and dst in both directions.
+// When one direction reaches EOF the write side of its destination is closed
+// so the peer sees EOF too, while the other direction keeps flowing until it
+// finishes as well. On errors or when half close is not supported both
+// conns are closed at once and the other direction is given up after
+// tunnelLinger. If idle is positive both conns are closed after no data
+// flowed in either direction for idle.
+// It returns bytes sent to dst and received from dst.
+func tunnel(dst, src net.Conn, idle time.Duration) (sent, received int64) {
+	var wg sync.WaitGroup
+	halfClosed := make(chan bool, 2)
+
+	if idle > 0 {
+		rawDst, rawSrc := dst, src
+		timer := time.AfterFunc(idle, func() {
+			rawDst.Close()
+			rawSrc.Close()
+		})
+		defer timer.Stop()
+
+		dst = &idleConn{dst, timer, idle}
+		src = &idleConn{src, timer, idle}
+	}
+
+	cp := func(to, from net.Conn, n *int64) {
+		defer wg.Done()
+		var err error
+		*n, err = io.Copy(to, from)
+		half := err == nil && closeWrite(to)
+		if !half {
+			to.Close()
+			from.Close()
+		}
+		halfClosed <- half
+	}
+
+	wg.Add(2)
+	go cp(dst, src, &sent)
+	go cp(src, dst, &received)
+
+	if <-halfClosed {
+		// a long download after the request was sent, the idle
+		// timeout bounds it if set
+		<-halfClosed
+	} else {
+		select {
+		case <-halfClosed:
+		case <-time.After(tunnelLinger):
+		}
+	}
+
+	dst.Close()
+	src.Close()
+	wg.Wait()
+	return
+}
+
+// idleConn resets timer whenever data is read so
+// the tunnel is only closed when it is idle
+type idleConn struct {
+	net.Conn
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+// closeWrite shuts down the writing side of c or of the conn it wraps,
+// it reports false if none of them supports it
+func closeWrite(c net.Conn) bool {
+	for {
+		if cw, ok := c.(closeWriter); ok {
+			return cw.CloseWrite() == nil
+		}
+		w, ok := c.(wrapper)
+		if !ok {
+			return false
+		}
+		c = w.unwrap()
+	}
+}
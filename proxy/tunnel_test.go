@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback tcp conn
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l := listen(t)
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestCloseWriteUnwraps(t *testing.T) {
+	client, server := tcpPair(t)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	var wrapped net.Conn = combine(strings.NewReader(""), server)
+	wrapped = &idleConn{wrapped, timer, time.Hour}
+	wrapped = &limitedConn{Conn: wrapped}
+	wrapped = &releaseConn{wrapped, func() {}}
+
+	if !closeWrite(wrapped) {
+		t.Fatal("closeWrite of wrapped tcp conn failed")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Errorf("peer did not see EOF: %v", err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if closeWrite(&releaseConn{a, func() {}}) {
+		t.Error("closeWrite of a pipe reported success")
+	}
+}
+
+func TestTunnelHalfClosedStream(t *testing.T) {
+	defer func(linger time.Duration) { tunnelLinger = linger }(tunnelLinger)
+	tunnelLinger = 50 * time.Millisecond
+
+	client, src := tcpPair(t)
+	dst, origin := tcpPair(t)
+	tunneled := make(chan struct{})
+	go func() {
+		tunnel(dst, src, 0)
+		close(tunneled)
+	}()
+
+	// the client half closes after its request, the origin streams
+	// its response for longer than tunnelLinger
+	client.Write([]byte("request"))
+	client.CloseWrite()
+	go func() {
+		defer origin.Close()
+		if req, _ := ioutil.ReadAll(origin); string(req) != "request" {
+			t.Errorf("origin got %q, want request", req)
+		}
+		for i := 0; i < 5; i++ {
+			time.Sleep(40 * time.Millisecond)
+			origin.Write([]byte("chunk"))
+		}
+	}()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := ioutil.ReadAll(client)
+	if want := strings.Repeat("chunk", 5); string(resp) != want || err != nil {
+		t.Errorf("client got %q, %v, want %q", resp, err, want)
+	}
+	<-tunneled
+}
+
+func TestTunnelIdleAfterHalfClose(t *testing.T) {
+	client, src := tcpPair(t)
+	dst, _ := tcpPair(t)
+
+	client.CloseWrite()
+	tunneled := make(chan struct{})
+	go func() {
+		tunnel(dst, src, 100*time.Millisecond)
+		close(tunneled)
+	}()
+
+	// the origin never answers, the idle timeout ends the tunnel
+	select {
+	case <-tunneled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("half closed tunnel not closed when idle")
+	}
+}
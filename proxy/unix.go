@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net"
+	"os"
+)
+
+// unixPrefix marks a listening address as a unix socket path
+const unixPrefix = "unix:"
+
+// listenUnix listens on the unix socket path, a stale socket left by
+// a crashed process is removed first. The socket file is removed again
+// when the listener is closed on Shutdown.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	return l, nil
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// isUpgrade tests whether h asks for a protocol upgrade like websocket
+func isUpgrade(h http.Header) bool {
+	return h.Get("Upgrade") != "" && headerHasToken(h, "Connection", "upgrade")
+}
+
+// handleUpgrade handles protocol upgrades like websocket. Upgraded conns
+// can not go through RoundTrip so the request is written to a tunnel
+// established via the pac selected proxy and the client conn is spliced
+// to it just like CONNECT does.
+func (s *Server) handleUpgrade(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := &accessRecord{ID: requestID(req.Context()), Remote: req.RemoteAddr, Client: clientName(req), Method: req.Method, URL: req.URL.String()}
+
+	if req.URL.Scheme != "http" {
+		rec.Error = "upgrade only supported for http"
+		s.logRequest(rec, start)
+		http.Error(w, rec.Error, http.StatusBadRequest)
+		return
+	}
+
+	hostport := req.URL.Host
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	dst, proxy, err := s.dialTarget(req.Context(), rec, s.pacURL(req.URL), hostport)
+	if err != nil {
+		rec.Error = err.Error()
+		s.logRequest(rec, start)
+		s.proxyError(w, err, errorStatus(err))
+		return
+	}
+	rec.Proxy = proxy.String()
+
+	upgrade := req.Header.Get("Upgrade")
+	outreq := req.Clone(req.Context())
+	s.prune(outreq.Header)
+	s.rewriteHeaders(outreq)
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", upgrade)
+	if _, ok := outreq.Header["User-Agent"]; !ok {
+		// do not let Write add the default User-Agent
+		outreq.Header.Set("User-Agent", "")
+	}
+
+	if err := outreq.Write(dst); err != nil {
+		dst.Close()
+		rec.Error = err.Error()
+		s.logRequest(rec, start)
+		s.proxyError(w, err, http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		dst.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	src, buf, err := hijacker.Hijack()
+	if err != nil {
+		dst.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	s.tunnels.Add(1)
+	defer s.tunnels.Done()
+	defer s.stats.begin(&s.stats.ActiveTunnels)()
+
+	// the upstream response including 101 Switching Protocols is relayed as is
+	rec.setup = time.Since(start)
+	dst, client := s.throttle(dst, combine(buf, src))
+	rec.Sent, rec.Received = tunnel(dst, client, s.tunnelIdle)
+	s.metrics.tunnel(rec.Sent, rec.Received)
+	s.logRequest(rec, start)
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/darren/gpac"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// UpstreamAuth maps upstream proxy host or host:port to
+// the Proxy-Authorization header value sent to it
+type UpstreamAuth map[string]string
+
+// String implements flag.Value
+func (u UpstreamAuth) String() string {
+	hosts := make([]string, 0, len(u))
+	for host := range u {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return strings.Join(hosts, ",")
+}
+
+// Set implements flag.Value, it parses host:user:pass or host:port:user:pass
+func (u UpstreamAuth) Set(v string) error {
+	parts := strings.SplitN(v, ":", 4)
+	if len(parts) == 4 && isPort(parts[1]) {
+		parts = []string{parts[0] + ":" + parts[1], parts[2], parts[3]}
+	} else {
+		parts = strings.SplitN(v, ":", 3)
+	}
+
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid upstream auth %q, want host:user:pass", v)
+	}
+
+	cred := base64.StdEncoding.EncodeToString([]byte(parts[1] + ":" + parts[2]))
+	u[parts[0]] = "Basic " + cred
+	return nil
+}
+
+func isPort(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup finds credentials for the proxy address, host:port match is
+// preferred over host only
+func (u UpstreamAuth) lookup(address string) string {
+	if auth, ok := u[address]; ok {
+		return auth
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	return u[host]
+}
+
+// socks returns the credentials for the socks5 proxy address,
+// nil if there are none
+func (u UpstreamAuth) socks(address string) *xproxy.Auth {
+	auth := u.lookup(address)
+	if !strings.HasPrefix(auth, "Basic ") {
+		return nil
+	}
+
+	cred, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(string(cred), ":", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	return &xproxy.Auth{User: parts[0], Password: parts[1]}
+}
+
+// apply sets or clears Proxy-Authorization in h for the proxy
+func (u UpstreamAuth) apply(h http.Header, proxy *gpac.Proxy) {
+	if proxy.IsDirect() || proxy.IsSOCKS() {
+		h.Del("Proxy-Authorization")
+		return
+	}
+
+	if auth := u.lookup(proxy.Address); auth != "" {
+		h.Set("Proxy-Authorization", auth)
+	} else {
+		h.Del("Proxy-Authorization")
+	}
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dialer returns the dial function for proxy.
+// For http proxies a CONNECT carrying the configured credentials is issued
+// and the tunnel is only returned after the proxy answered 200.
+// Proxies are reached with forward so Options.Dialer applies to them too,
+// with a next hop DIRECT connects through it and connections to
+// other proxies are tunneled through it.
+func (s *Server) dialer(proxy *gpac.Proxy) dialFunc {
+	forward := s.forward()
+
+	switch proxy.Type {
+	case "PROXY", "HTTP":
+		return s.connectDialer(proxy, forward)
+	case "HTTPS":
+		return s.connectDialer(proxy, s.tlsDialer(forward))
+	case "DIRECT":
+		if s.nextHop != nil {
+			return forward
+		}
+		return s.dialDirect
+	case "SOCKS4":
+		// gpac speaks socks5 for both SOCKS and SOCKS5
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return socks4Dial(ctx, forward, proxy.Address, address)
+		}
+	case "SOCKS", "SOCKS5":
+		d, _ := xproxy.SOCKS5("tcp", proxy.Address, s.upstreamAuth.socks(proxy.Address), forward)
+		return d.(xproxy.ContextDialer).DialContext
+	default:
+		return proxy.Dialer()
+	}
+}
+
+// forward returns the dial function to reach upstream proxies,
+// through the next hop if there is one
+func (s *Server) forward() dialFunc {
+	if s.nextHop == nil {
+		return s.dialDirect
+	}
+	return s.connectDialer(s.nextHop, s.dialDirect)
+}
+
+// tlsDialer returns the dial function to reach https proxies, the
+// conn made with forward is wrapped in tls verifying the proxy certificate
+// unless upstreamInsecure
+func (s *Server) tlsDialer(forward dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := forward(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		tconn := tls.Client(conn, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: s.upstreamInsecure,
+		})
+
+		if deadline, ok := ctx.Deadline(); ok {
+			tconn.SetDeadline(deadline)
+			defer tconn.SetDeadline(time.Time{})
+		}
+
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tconn, nil
+	}
+}
+
+// DialContext implements proxy.ContextDialer
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// Dial implements proxy.Dialer
+func (f dialFunc) Dial(network, address string) (net.Conn, error) {
+	return f(context.Background(), network, address)
+}
+
+// connectDialer returns the dial function issuing CONNECT to the http
+// proxy, the connection to proxy itself is made with forward
+func (s *Server) connectDialer(proxy *gpac.Proxy, forward dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := forward(ctx, network, proxy.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		connectReq := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+
+		// the body is not closed, closing would drain the tunnel as
+		// a chunked body when the proxy announced one, eg: go servers
+		br := bufio.NewReader(conn)
+		var resp *http.Response
+		if creds, ok := s.ntlmProxy(proxy); ok {
+			resp, err = ntlmHandshake(conn, br, connectReq, creds)
+		} else {
+			s.upstreamAuth.apply(connectReq.Header, proxy)
+			if err = connectReq.Write(conn); err == nil {
+				resp, err = http.ReadResponse(br, connectReq)
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, &connectError{proxy.String(), address, resp.StatusCode, resp.Status}
+		}
+
+		if br.Buffered() > 0 {
+			return combine(br, conn), nil
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// connect sends CONNECT target to the proxy at ts and returns its answer
+// and the conn, which is tunneled on success
+func connect(t *testing.T, ts *httptest.Server, target string) (*http.Response, string, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: target}, Host: target, Header: make(http.Header)}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body), conn
+	}
+	return resp, "", combine(br, conn)
+}
+
+func TestConnectRejectedByUpstream(t *testing.T) {
+	tests := []struct {
+		upstream int
+		client   int
+	}{
+		// our credentials were refused, the client can not fix that
+		{http.StatusProxyAuthRequired, http.StatusBadGateway},
+		{http.StatusForbidden, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		rejecting := newOriginFunc(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect {
+				t.Errorf("upstream got %s, want CONNECT", r.Method)
+			}
+			w.Header().Set("Proxy-Authenticate", `Basic realm="upstream"`)
+			w.WriteHeader(tt.upstream)
+		})
+		_, ts := newTestServer(t, Options{Finder: staticFinder("PROXY " + rejecting.Listener.Addr().String())})
+
+		resp, body, _ := connect(t, ts, "example.com:443")
+		if resp.StatusCode != tt.client {
+			t.Errorf("upstream %d: CONNECT = %d, want %d", tt.upstream, resp.StatusCode, tt.client)
+		}
+		if want := "upstream proxy replied " + strconv.Itoa(tt.upstream); !strings.Contains(body, want) {
+			t.Errorf("upstream %d: body %q does not contain %q", tt.upstream, body, want)
+		}
+		if h := resp.Header.Get("Proxy-Authenticate"); h != "" {
+			t.Errorf("upstream %d: Proxy-Authenticate %q relayed to the client", tt.upstream, h)
+		}
+	}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	origin := newOrigin(t, "hello")
+	tlsOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer tlsOrigin.Close()
+	// its certificate is self signed, verifying it fails
+	up := startUpstream(t, httptest.NewTLSServer)
+	finder := staticFinder("HTTPS " + up.addr)
+
+	tests := []struct {
+		insecure bool
+		code     int
+		upstream int64 // requests the upstream proxy got so far
+	}{
+		{false, http.StatusBadGateway, 0},
+		{true, http.StatusOK, 2},
+	}
+
+	for _, tt := range tests {
+		_, ts := newTestServer(t, Options{Finder: finder, UpstreamInsecure: tt.insecure, VerboseErrors: true})
+		client := proxyClient(t, ts)
+
+		code, body := get(t, client, origin.URL)
+		if code != tt.code {
+			t.Errorf("insecure %v: GET = %d %q, want %d", tt.insecure, code, body, tt.code)
+		}
+		if !tt.insecure && !strings.Contains(body, "certificate") {
+			t.Errorf("GET failed with %q, want a certificate error", body)
+		}
+
+		resp, body, _ := connect(t, ts, tlsOrigin.Listener.Addr().String())
+		if resp.StatusCode != tt.code {
+			t.Errorf("insecure %v: CONNECT = %d %q, want %d", tt.insecure, resp.StatusCode, body, tt.code)
+		}
+
+		if n := up.count(); n != tt.upstream {
+			t.Errorf("insecure %v: upstream got %d requests, want %d", tt.insecure, n, tt.upstream)
+		}
+	}
+
+	// the tunnel through the https proxy reaches the origin
+	_, ts := newTestServer(t, Options{Finder: finder, UpstreamInsecure: true})
+	if code, body := get(t, proxyClient(t, ts), tlsOrigin.URL); code != http.StatusOK || body != "secure" {
+		t.Errorf("GET %s = %d %q, want 200 secure", tlsOrigin.URL, code, body)
+	}
+}
+
+// socksUpstream is a socks proxy connecting directly, counting
+// handshakes by socks version
+type socksUpstream struct {
+	addr     string
+	mu       sync.Mutex
+	versions []byte
+}
+
+func (u *socksUpstream) seen() []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]byte(nil), u.versions...)
+}
+
+// versionListener records the version byte of each conn accepted
+type versionListener struct {
+	net.Listener
+	u *socksUpstream
+}
+
+func (l *versionListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	if version, err := br.Peek(1); err == nil {
+		l.u.mu.Lock()
+		l.u.versions = append(l.u.versions, version[0])
+		l.u.mu.Unlock()
+	}
+	return combine(br, conn), nil
+}
+
+func listenSocks(t *testing.T) (net.Listener, *socksUpstream) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	u := &socksUpstream{addr: l.Addr().String()}
+	return &versionListener{l, u}, u
+}
+
+// newSocks5Upstream serves pacroxy's socks5 listener
+func newSocks5Upstream(t *testing.T) *socksUpstream {
+	t.Helper()
+	l, u := listenSocks(t)
+	s := newTestProxy(t, Options{Finder: staticFinder("DIRECT")})
+	go s.serveSocks(l)
+	return u
+}
+
+// newSocks4Upstream serves a minimal socks4 proxy, ip targets only
+func newSocks4Upstream(t *testing.T) *socksUpstream {
+	t.Helper()
+	l, u := listenSocks(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				// VN CD DSTPORT DSTIP USERID NUL
+				var req [8]byte
+				if _, err := io.ReadFull(br, req[:]); err != nil || req[0] != socksVersion4 {
+					return
+				}
+				if _, err := br.ReadString(0); err != nil {
+					return
+				}
+				target := net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(req[2])<<8|int(req[3])))
+				dst, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer dst.Close()
+				conn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+				tunnel(dst, combine(br, conn), 0)
+			}()
+		}
+	}()
+	return u
+}
+
+func TestSocksUpstream(t *testing.T) {
+	origin := newOrigin(t, "hello")
+	tlsOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer tlsOrigin.Close()
+
+	tests := []struct {
+		typ     string
+		version byte // of the handshakes the upstream got
+		start   func(*testing.T) *socksUpstream
+	}{
+		{"SOCKS", 5, newSocks5Upstream},
+		{"SOCKS5", 5, newSocks5Upstream},
+		{"SOCKS4", socksVersion4, newSocks4Upstream},
+	}
+
+	for _, tt := range tests {
+		up := tt.start(t)
+		_, ts := newTestServer(t, Options{Finder: staticFinder(tt.typ + " " + up.addr)})
+		client := proxyClient(t, ts)
+
+		if code, body := get(t, client, origin.URL); code != http.StatusOK || body != "hello" {
+			t.Errorf("%s: GET = %d %q, want 200 hello", tt.typ, code, body)
+		}
+		// a CONNECT tunnel
+		if code, body := get(t, client, tlsOrigin.URL); code != http.StatusOK || body != "secure" {
+			t.Errorf("%s: GET %s = %d %q, want 200 secure", tt.typ, tlsOrigin.URL, code, body)
+		}
+
+		versions := up.seen()
+		if len(versions) != 2 {
+			t.Errorf("%s: upstream got %d conns, want 2", tt.typ, len(versions))
+		}
+		for _, v := range versions {
+			if v != tt.version {
+				t.Errorf("%s: upstream got a socks%d handshake, want socks%d", tt.typ, v, tt.version)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// resolvConf is read for the search domains used by wpad discovery
+const resolvConf = "/etc/resolv.conf"
+
+// searchDomains returns the domains of resolvConf search and domain lines
+// followed by the domain of the host name
+func searchDomains() []string {
+	var domains []string
+
+	if f, err := os.Open(resolvConf); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 1 && (fields[0] == "search" || fields[0] == "domain") {
+				domains = append(domains, fields[1:]...)
+			}
+		}
+		f.Close()
+	}
+
+	if host, err := os.Hostname(); err == nil {
+		if i := strings.IndexByte(host, '.'); i > 0 {
+			domains = append(domains, host[i+1:])
+		}
+	}
+	return domains
+}
+
+// wpadCandidates builds wpad urls for domains, walking up each domain
+// until two labels are left, eg: a.b.example.com gives wpad.a.b.example.com,
+// wpad.b.example.com and wpad.example.com
+func wpadCandidates(domains []string) []string {
+	var urls []string
+	seen := make(map[string]bool)
+
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		for strings.Count(domain, ".") >= 1 {
+			url := "http://wpad." + domain + "/wpad.dat"
+			if !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+			domain = domain[strings.IndexByte(domain, '.')+1:]
+		}
+	}
+	return urls
+}
+
+var errNoWPAD = errors.New("no wpad url found")
+
+// discoverWPAD returns the first wpad candidate serving a valid pac file
+func discoverWPAD(timeout time.Duration, f *fetcher) (string, error) {
+	for _, url := range wpadCandidates(searchDomains()) {
+		if _, err := loadPac(newSource(url, f), timeout); err == nil {
+			return url, nil
+		}
+	}
+	return "", errNoWPAD
+}
+
+// wpadSources discovers the pac url with wpad, using fallback
+// when discovery fails
+func wpadSources(logger Logger, timeout time.Duration, f *fetcher, fallback []string) []string {
+	url, err := discoverWPAD(timeout, f)
+	if err != nil {
+		logger.Printf("WPAD discovery failed: %v, using %s", err, strings.Join(fallback, ","))
+		return fallback
+	}
+	logger.Printf("WPAD discovered %s", url)
+	return []string{url}
+}
+
+// sameSources tests whether a and b list the same pac sources
+func sameSources(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}